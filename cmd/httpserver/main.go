@@ -1,45 +1,98 @@
 package main
 
 import (
-	"io"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/mbeka02/go_http/internal/request"
+	"github.com/mbeka02/go_http/internal/response"
+	"github.com/mbeka02/go_http/internal/router"
 	"github.com/mbeka02/go_http/internal/server"
 )
 
-const port = 42069
+const (
+	port            = 42069
+	shutdownTimeout = 10 * time.Second
+)
 
 func main() {
-	handler := func(w io.Writer, req *request.Request) *server.HandlerError {
-		switch req.RequestLine.RequestTarget {
-		case "/yourproblem":
-			return &server.HandlerError{
-				Message:    "Your problem is not my problem\n",
-				StatusCode: 400,
-			}
-		case "/myproblem":
-			return &server.HandlerError{
-				Message:    "Woopsie, my bad\n",
-				StatusCode: 500,
+	r := router.New()
+	r.Handle("/yourproblem", func(w server.ResponseWriter, req *request.Request) *server.HandlerError {
+		return &server.HandlerError{
+			Message:    "Your problem is not my problem\n",
+			StatusCode: response.StatusCodeBadRequest,
+		}
+	})
+	r.Handle("/myproblem", func(w server.ResponseWriter, req *request.Request) *server.HandlerError {
+		return &server.HandlerError{
+			Message:    "Woopsie, my bad\n",
+			StatusCode: response.StatusCodeInternalServerError,
+		}
+	})
+	r.Handle("GET /stream", func(w server.ResponseWriter, req *request.Request) *server.HandlerError {
+		w.Header().Set("Trailer", "X-Content-SHA256, X-Content-Length")
+		hash := sha256.New()
+		length := 0
+		// each line is flushed to the client as a separate chunk
+		for i := 1; i <= 5; i++ {
+			line := fmt.Sprintf("chunk %d\n", i)
+			w.Write([]byte(line))
+			w.Flush()
+			hash.Write([]byte(line))
+			length += len(line)
+			// stop early if the client went away or the server stopped waiting for the stream to end
+			select {
+			case <-req.Context().Done():
+				return nil
+			case <-time.After(200 * time.Millisecond):
 			}
-		default:
-			w.Write([]byte("All good, frfr\n"))
-			return nil
 		}
-	}
-	server, err := server.Serve(port, handler)
+		w.Header().Set("X-Content-SHA256", hex.EncodeToString(hash.Sum(nil)))
+		w.Header().Set("X-Content-Length", strconv.Itoa(length))
+		return nil
+	})
+	r.Handle("GET /greet/{name}", func(w server.ResponseWriter, req *request.Request) *server.HandlerError {
+		fmt.Fprintf(w, "Hello, %s\n", req.PathValue("name"))
+		return nil
+	})
+	r.Handle("/{path...}", func(w server.ResponseWriter, req *request.Request) *server.HandlerError {
+		w.Write([]byte("All good, frfr\n"))
+		return nil
+	})
+	handler := server.Chain(r.Route, server.Logging, server.Recover, server.RequestID, server.Timing)
+	// use the socket passed by systemd when started through socket activation
+	listeners, err := server.ListenersFromEnv()
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer server.Close()
-	log.Println("Server started on port", port)
+	var srv *server.Server
+	if len(listeners) > 0 {
+		srv = server.ServeListener(listeners[0], handler)
+		log.Println("Server started on", listeners[0].Addr())
+	} else {
+		srv, err = server.Serve(port, handler)
+		if err != nil {
+			log.Fatalf("Error starting server: %v", err)
+		}
+		log.Println("Server started on port", port)
+	}
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
+	// give in-flight requests a chance to finish before exiting
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down the server: %v", err)
+	}
 	log.Println("Server gracefully stopped")
 }
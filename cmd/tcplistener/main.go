@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"net"
 
@@ -25,9 +26,13 @@ func main() {
 		// read and parse data from the connection
 		request, err := request.RequestFromReader(conn)
 		fmt.Printf("\nRequest line:\n- Method:  %s\n- Target:  %s\n- Version: %s\nHeaders:\n", request.RequestLine.Method, request.RequestLine.RequestTarget, request.RequestLine.HttpVersion)
-		for key, value := range request.Headers {
+		for key, value := range request.Headers.All() {
 			fmt.Printf("- %s: %s\n", key, value)
 		}
-		fmt.Printf("Body:\n%s", string(request.Body))
+		body, err := io.ReadAll(request.Body)
+		if err != nil {
+			log.Printf("error reading the body:%v", err)
+		}
+		fmt.Printf("Body:\n%s", string(body))
 	}
 }
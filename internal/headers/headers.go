@@ -3,29 +3,56 @@ package headers
 import (
 	"bytes"
 	"fmt"
+	"iter"
 	"log"
 	"regexp"
 	"strings"
 )
 
-type Headers map[string]string
+// Headers is an ordered list of fields. Names keep the casing they were given while lookups ignore it,
+// and a name can appear more than once since some fields like Set-Cookie can't be combined into a single line.
+type Headers struct {
+	fields []Field
+}
+
+// Field is a single "name: value" line
+type Field struct {
+	Name  string
+	Value string
+}
 
 var (
-	ERROR_INVALID_FIELD_LINE = fmt.Errorf("the field line is invalid , unable to add it to the parsed headers")
-	ERROR_INVALID_FIELD_NAME = fmt.Errorf("the field name is invalid , it likely contains whitespace")
-	ERROR_MISSING_HEADER_KEY = fmt.Errorf("header does not exist")
-	ERROR_INVALID_HEADER_KEY = fmt.Errorf("The header key contains an invalid character")
+	ERROR_INVALID_FIELD_LINE  = fmt.Errorf("the field line is invalid , unable to add it to the parsed headers")
+	ERROR_INVALID_FIELD_NAME  = fmt.Errorf("the field name is invalid , it likely contains whitespace")
+	ERROR_MISSING_HEADER_KEY  = fmt.Errorf("header does not exist")
+	ERROR_INVALID_HEADER_KEY  = fmt.Errorf("The header key contains an invalid character")
+	ERROR_INVALID_FIELD_VALUE = fmt.Errorf("the field value contains an invalid character")
+	ERROR_OBS_FOLD            = fmt.Errorf("the field value is folded across lines , obsolete line folding is not accepted")
 )
+
+// ObsFoldPolicy decides what happens to a field value continued on the next line by starting that line with whitespace (obs-fold),
+// RFC 9112 leaves the choice between rejecting the message and replacing the fold with a space to the recipient.
+type ObsFoldPolicy int
+
+const (
+	ObsFoldReject  ObsFoldPolicy = iota // 0
+	ObsFoldReplace                      // 1
+)
+
+// ParseConfig holds the optional settings of ParseWithConfig(), the zero value rejects obs-fold
+type ParseConfig struct {
+	ObsFold ObsFoldPolicy
+}
+
 var fieldNameRegex = regexp.MustCompile(`^[a-zA-Z0-9!#$%&'*+\-.^_` + "`" + `|~]+$`)
 
-func NewHeaders() Headers {
-	h := make(map[string]string)
-	return h
+func NewHeaders() *Headers {
+	return &Headers{}
 }
 
-func (h Headers) Get(key string) string {
-	formattedKey := strings.ToLower(key)
-	val, ok := h[formattedKey]
+// Get() returns the values of key combined into a single comma separated value, which is how the spec says repeated fields should be read
+func (h *Headers) Get(key string) string {
+	val, ok := h.Lookup(key)
 	if !ok {
 		log.Println(ERROR_MISSING_HEADER_KEY)
 
@@ -34,19 +61,88 @@ func (h Headers) Get(key string) string {
 	return val
 }
 
-func (h Headers) Set(key, value string) {
-	formattedKey := strings.ToLower(key)
-	h[formattedKey] = value
+// Lookup() is Get() for callers that need to tell a missing field from an empty one
+func (h *Headers) Lookup(key string) (string, bool) {
+	values := h.Values(key)
+	if values == nil {
+		return "", false
+	}
+	return strings.Join(values, ","), true
+}
+
+// Values() returns every value of key in the order they were added, or nil if there are none
+func (h *Headers) Values(key string) []string {
+	var values []string
+	for _, field := range h.fields {
+		if strings.EqualFold(field.Name, key) {
+			values = append(values, field.Value)
+		}
+	}
+	return values
+}
+
+// Set() replaces the values of key with value, the field keeps its position if it already exists
+func (h *Headers) Set(key, value string) {
+	for i, field := range h.fields {
+		if strings.EqualFold(field.Name, key) {
+			h.fields[i] = Field{Name: key, Value: value}
+			h.delFrom(key, i+1)
+			return
+		}
+	}
+	h.Add(key, value)
+}
+
+// Add() appends a value for key after the existing ones
+func (h *Headers) Add(key, value string) {
+	h.fields = append(h.fields, Field{Name: key, Value: value})
+}
+
+// Del() removes every value of key
+func (h *Headers) Del(key string) {
+	h.delFrom(key, 0)
+}
+
+// delFrom() removes the values of key that come after the first start fields
+func (h *Headers) delFrom(key string, start int) {
+	kept := h.fields[:start]
+	for _, field := range h.fields[start:] {
+		if !strings.EqualFold(field.Name, key) {
+			kept = append(kept, field)
+		}
+	}
+	h.fields = kept
+}
+
+// Len() returns the number of fields, a name that appears twice counts twice
+func (h *Headers) Len() int {
+	return len(h.fields)
+}
+
+// All() iterates over the fields in order
+func (h *Headers) All() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		for _, field := range h.fields {
+			if !yield(field.Name, field.Value) {
+				return
+			}
+		}
+	}
 }
 
-func (h Headers) List() {
-	for key, val := range h {
+func (h *Headers) List() {
+	for key, val := range h.All() {
 		fmt.Println("Key:", key, "Value:", val)
 	}
 }
 
-// Parse() reads data and calls parseHeader() that adds individual headers to the map// it returns the amount of data read , the parser state and an error
-func (h Headers) Parse(data []byte) (int, bool, error) {
+// Parse() reads data and calls parseHeader() that adds individual headers to the list// it returns the amount of data read , the parser state and an error
+func (h *Headers) Parse(data []byte) (int, bool, error) {
+	return h.ParseWithConfig(data, ParseConfig{})
+}
+
+// ParseWithConfig() is Parse() with control over how folded values are handled
+func (h *Headers) ParseWithConfig(data []byte, config ParseConfig) (int, bool, error) {
 	crlf := []byte("\r\n")
 	dataRead := 0
 	done := false
@@ -64,25 +160,70 @@ func (h Headers) Parse(data []byte) (int, bool, error) {
 			break
 		}
 
-		fieldName, fieldValue, err := parseHeader(data[dataRead : dataRead+idx])
+		line := data[dataRead : dataRead+idx]
+		if line[0] == ' ' || line[0] == '\t' {
+			if err := h.unfold(line, config.ObsFold); err != nil {
+				log.Println(err)
+				return dataRead, done, err
+			}
+			dataRead += idx + len(crlf)
+			continue
+		}
+		fieldName, fieldValue, err := parseHeader(line)
 		if err != nil {
 			log.Println(err)
 			return dataRead, done, err
 		}
 		dataRead += idx + len(crlf)
 		// fmt.Println("read:", dataRead, "bytes")
-		// add the pair to the headers map
-		val, ok := h[fieldName]
-		if ok {
-			// concat the new value if the key already exists
-			h[fieldName] = val + "," + fieldValue
-		} else {
-			h[fieldName] = fieldValue
-		}
+		// repeated fields are kept as separate values, Get() combines them when needed
+		h.Add(fieldName, fieldValue)
 	}
 	return dataRead, done, nil
 }
 
+// unfold() appends a continuation line to the value of the last field, or rejects it depending on the policy
+func (h *Headers) unfold(line []byte, policy ObsFoldPolicy) error {
+	// there is nothing to continue at the start of the section
+	if len(h.fields) == 0 {
+		return ERROR_INVALID_FIELD_LINE
+	}
+	if policy != ObsFoldReplace {
+		return ERROR_OBS_FOLD
+	}
+	continuation := bytes.Trim(line, " \t")
+	if !ValidFieldValue(string(continuation)) {
+		return ERROR_INVALID_FIELD_VALUE
+	}
+	if len(continuation) == 0 {
+		return nil
+	}
+	last := &h.fields[len(h.fields)-1]
+	if last.Value == "" {
+		last.Value = string(continuation)
+	} else {
+		last.Value += " " + string(continuation)
+	}
+	return nil
+}
+
+// ValidFieldName() reports whether name is a token as required for field names
+func ValidFieldName(name string) bool {
+	return fieldNameRegex.MatchString(name)
+}
+
+// ValidFieldValue() reports whether value only contains visible characters, spaces, tabs and obs-text as allowed by the RFC 9110 field-value grammar.
+// Control characters such as CR, LF and NUL are never allowed.
+func ValidFieldValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if (c < 0x20 && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
 // A helper function that parses individual field lines
 func parseHeader(fieldLine []byte) (string, string, error) {
 	pair := bytes.SplitN(fieldLine, []byte(":"), 2)
@@ -93,17 +234,21 @@ func parseHeader(fieldLine []byte) (string, string, error) {
 		return "", "", ERROR_INVALID_FIELD_LINE
 	}
 	fieldName := pair[0]
-	fieldValue := bytes.TrimSpace(pair[1])
+	// only spaces and tabs count as optional whitespace around the value
+	fieldValue := bytes.Trim(pair[1], " \t")
 	// Ensure there's no whitespace betwixt the field name and colon
-	if bytes.HasSuffix(fieldName, []byte(" ")) {
+	if bytes.HasSuffix(fieldName, []byte(" ")) || bytes.HasSuffix(fieldName, []byte("\t")) {
 		return "", "", ERROR_INVALID_FIELD_NAME
 	}
-	formattedFieldName := strings.TrimSpace(strings.ToLower(string(fieldName)))
+	formattedFieldName := strings.TrimSpace(string(fieldName))
 	// ensure the field name uses valid characters
 	match := fieldNameRegex.MatchString(formattedFieldName)
 	if !match {
 		return "", "", ERROR_INVALID_HEADER_KEY
 	}
 	formattedFieldValue := string(fieldValue)
+	if !ValidFieldValue(formattedFieldValue) {
+		return "", "", ERROR_INVALID_FIELD_VALUE
+	}
 	return formattedFieldName, formattedFieldValue, nil
 }
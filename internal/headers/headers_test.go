@@ -14,12 +14,12 @@ func TestHeaderParsing(t *testing.T) {
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", headers.Get("host"))
 	assert.Equal(t, 25, n)
 	assert.True(t, done)
 
 	// Test: Valid 2 headers with existing headers
-	data = []byte("Key1: Value1\r\n  Key2: Value2 \r\n\r\n")
+	data = []byte("Key1: Value1\r\nKey2: Value2 \r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
@@ -55,10 +55,83 @@ func TestHeaderParsing(t *testing.T) {
 
 	// Test: Multiple values for a single header key
 	headers = NewHeaders()
-	data = []byte("Key1: Value1\r\n  Key1: Value2\r\n  Key1:Value3 \r\n\r\n")
+	data = []byte("Key1: Value1\r\nKey1: Value2\r\nKey1:Value3 \r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
-	assert.Equal(t, 48, n)
+	assert.Equal(t, 44, n)
 	assert.True(t, done)
 	assert.Equal(t, "Value1,Value2,Value3", headers.Get("key1"))
 }
+
+func TestHeaderValues(t *testing.T) {
+	// Test: Repeated fields keep their values and order
+	headers := NewHeaders()
+	data := []byte("Set-Cookie: a=1; Path=/\r\nHost: localhost\r\nset-cookie: b=2\r\n\r\n")
+	_, done, err := headers.Parse(data)
+	require.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, []string{"a=1; Path=/", "b=2"}, headers.Values("SET-COOKIE"))
+	assert.Nil(t, headers.Values("cookie"))
+	assert.Equal(t, 3, headers.Len())
+
+	// Test: Names keep their casing
+	var names []string
+	for name := range headers.All() {
+		names = append(names, name)
+	}
+	assert.Equal(t, []string{"Set-Cookie", "Host", "set-cookie"}, names)
+
+	// Test: Set replaces every value in place
+	headers.Set("Set-Cookie", "c=3")
+	headers.Add("X-Extra", "1")
+	var fields []Field
+	for name, value := range headers.All() {
+		fields = append(fields, Field{name, value})
+	}
+	assert.Equal(t, []Field{{"Set-Cookie", "c=3"}, {"Host", "localhost"}, {"X-Extra", "1"}}, fields)
+
+	// Test: Del removes every value
+	headers.Add("x-extra", "2")
+	headers.Del("X-EXTRA")
+	_, ok := headers.Lookup("x-extra")
+	assert.False(t, ok)
+	assert.Equal(t, 2, headers.Len())
+}
+
+func TestHeaderFieldValues(t *testing.T) {
+	// Test: Control characters in the value
+	for _, value := range []string{"a\rb", "a\x00b", "a\nb", "a\x7fb", "a\vb"} {
+		headers := NewHeaders()
+		_, _, err := headers.Parse([]byte("Key: " + value + "\r\n\r\n"))
+		require.ErrorIs(t, err, ERROR_INVALID_FIELD_VALUE, "%q", value)
+	}
+
+	// Test: Tabs and obs-text are allowed
+	headers := NewHeaders()
+	_, done, err := headers.Parse([]byte("Key:\ta\tb \xe9\t\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, "a\tb \xe9", headers.Get("key"))
+
+	// Test: Obsolete line folding is rejected by default
+	headers = NewHeaders()
+	data := []byte("Key: a\r\n  b\r\n\r\n")
+	n, done, err := headers.Parse(data)
+	require.ErrorIs(t, err, ERROR_OBS_FOLD)
+	assert.Equal(t, 8, n)
+	assert.False(t, done)
+
+	// Test: Obsolete line folding replaced with a space
+	headers = NewHeaders()
+	n, done, err = headers.ParseWithConfig(data, ParseConfig{ObsFold: ObsFoldReplace})
+	require.NoError(t, err)
+	assert.Equal(t, len(data), n)
+	assert.True(t, done)
+	assert.Equal(t, "a b", headers.Get("key"))
+	assert.Equal(t, 1, headers.Len())
+
+	// Test: A fold can't start the section
+	headers = NewHeaders()
+	_, _, err = headers.ParseWithConfig([]byte(" Key: a\r\n\r\n"), ParseConfig{ObsFold: ObsFoldReplace})
+	require.ErrorIs(t, err, ERROR_INVALID_FIELD_LINE)
+}
@@ -0,0 +1,110 @@
+package request
+
+import (
+	"errors"
+	"io"
+)
+
+// DiscardBody() reads and throws away up to limit bytes of the body the handler left unread, even if it closed Body.
+// It returns an error if the rest of the body couldn't be consumed, in which case the connection can't be reused.
+func (r *Request) DiscardBody(limit int64) error {
+	if r.body == nil {
+		return nil
+	}
+	// r may be a copy made by WithContext() so the parser state is read from the request that owns the body
+	owner := r.body.req
+	scratch := make([]byte, bodyBufferSize)
+	for discarded := int64(0); owner.Status != RequestStateDone || len(owner.pending) > 0; {
+		if discarded >= limit {
+			return ERROR_BODY_NOT_DRAINED
+		}
+		n, err := r.body.read(scratch[:min(int64(len(scratch)), limit-discarded)])
+		discarded += int64(n)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type bodyReader struct {
+	req *Request
+	src io.Reader
+	// raw bytes read from src that haven't been parsed yet
+	buf         []byte
+	readToIndex int
+	// readErr is the error returned by src, err is the one handed to the caller
+	readErr error
+	err     error
+	closed  bool
+}
+
+func newBodyReader(req *Request, src io.Reader, leftover []byte) *bodyReader {
+	buf := make([]byte, max(bodyBufferSize, len(leftover)))
+	return &bodyReader{req: req, src: src, buf: buf, readToIndex: copy(buf, leftover)}
+}
+
+func (b *bodyReader) Read(data []byte) (int, error) {
+	if b.closed {
+		return 0, ERROR_BODY_CLOSED
+	}
+	return b.read(data)
+}
+
+// Close() stops the handler from reading any more of the body, the server discards whatever is left before reusing the connection
+func (b *bodyReader) Close() error {
+	b.closed = true
+	return nil
+}
+
+// read() hands out decoded body bytes, parsing more of the raw data from src whenever it runs out
+func (b *bodyReader) read(data []byte) (int, error) {
+	for {
+		if len(b.req.pending) > 0 {
+			n := copy(data, b.req.pending)
+			b.req.pending = b.req.pending[n:]
+			return n, nil
+		}
+		if b.req.Status == RequestStateDone {
+			return 0, io.EOF
+		}
+		if b.err != nil {
+			return 0, b.err
+		}
+		// parse what has already been read before reading more
+		bytesParsed, err := b.req.parse(b.buf[:b.readToIndex])
+		if err != nil {
+			b.err = err
+			continue
+		}
+		copy(b.buf, b.buf[bytesParsed:b.readToIndex])
+		b.readToIndex -= bytesParsed
+		if len(b.req.pending) > 0 || b.req.Status == RequestStateDone {
+			continue
+		}
+		// the parser needs more data than src can give
+		if b.readErr != nil {
+			b.err = b.readErr
+			continue
+		}
+		// Doubles the buffer size when a single line (chunk size or trailer) doesn't fit, the limits keep this bounded
+		if b.readToIndex == len(b.buf) {
+			newBuf := make([]byte, len(b.buf)*2)
+			copy(newBuf, b.buf)
+			b.buf = newBuf
+		}
+		bytesRead, err := b.src.Read(b.buf[b.readToIndex:])
+		b.readToIndex += bytesRead
+		if err != nil {
+			// the connection ended before the body did
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			// kept aside until the bytes read alongside it have been parsed
+			b.readErr = err
+		}
+	}
+}
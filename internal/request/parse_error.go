@@ -0,0 +1,74 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ParsePhase is the part of the message the parser was working on
+type ParsePhase int
+
+const (
+	ParsePhaseRequestLine ParsePhase = iota // 0
+	ParsePhaseHeaders                       // 1
+	ParsePhaseBody                          // 2
+)
+
+func (p ParsePhase) String() string {
+	switch p {
+	case ParsePhaseRequestLine:
+		return "request-line"
+	case ParsePhaseHeaders:
+		return "headers"
+	default:
+		return "body"
+	}
+}
+
+// ParseError is returned for a request that can't be parsed. It wraps one of the ERROR_ values so errors.Is() still works on it,
+// and carries the status code the server should answer with.
+type ParseError struct {
+	Phase ParsePhase
+	// Offset is the position in the message, counted from the first byte of the request line, of the element that couldn't be parsed
+	Offset     int
+	StatusCode int
+	Err        error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s: %v (at byte %d)", e.Phase, e.Err, e.Offset)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// parseError() wraps err with the phase the parser is in, n is how far into the current data the error was found
+func (r *Request) parseError(err error, n int) *ParseError {
+	phase := ParsePhaseBody
+	switch r.Status {
+	case RequestStateInitialized:
+		phase = ParsePhaseRequestLine
+	case RequestStateParsingHeaders:
+		phase = ParsePhaseHeaders
+	}
+	return &ParseError{Phase: phase, Offset: r.offset + n, StatusCode: parseErrorStatus(err), Err: err}
+}
+
+// parseErrorStatus() picks the status code for a parse error, anything that isn't about a limit or an unsupported feature is a plain 400
+func parseErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ERROR_REQUEST_LINE_TOO_LONG):
+		return 414
+	case errors.Is(err, ERROR_HEADERS_TOO_LARGE):
+		return 431
+	case errors.Is(err, ERROR_BODY_TOO_LARGE):
+		return 413
+	case errors.Is(err, ERROR_UNSUPPORTED_TRANSFER_ENCODING):
+		return 501
+	case errors.Is(err, ERROR_UNSUPPORTED_HTTP_VERSION):
+		return 505
+	default:
+		return 400
+	}
+}
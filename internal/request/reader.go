@@ -0,0 +1,45 @@
+package request
+
+import "io"
+
+// Reader parses the requests a client sends one after another on the same connection.
+// Bytes read past the end of a request, like the start of a pipelined one, are kept for the next call to ReadRequest().
+type Reader struct {
+	src    io.Reader
+	config Config
+	// the last request returned, its body reader holds the leftover bytes
+	last *Request
+}
+
+func NewReader(src io.Reader, config Config) *Reader {
+	return &Reader{src: src, config: config}
+}
+
+// ReadRequest() parses the next request on the connection. The body of the previous one has to be read to the end first, see DiscardBody().
+func (rd *Reader) ReadRequest() (*Request, error) {
+	if rd.last != nil && !rd.last.bodyConsumed() {
+		return nil, ERROR_BODY_NOT_CONSUMED
+	}
+	request, err := requestFromReader(rd.src, rd.leftover(), rd.config)
+	if err != nil {
+		return nil, err
+	}
+	rd.last = request
+	return request, nil
+}
+
+// Buffered() returns how many bytes of the next request have already been read from the connection
+func (rd *Reader) Buffered() int {
+	return len(rd.leftover())
+}
+
+func (rd *Reader) leftover() []byte {
+	if rd.last == nil || rd.last.body == nil || !rd.last.bodyConsumed() {
+		return nil
+	}
+	return rd.last.body.buf[:rd.last.body.readToIndex]
+}
+
+func (r *Request) bodyConsumed() bool {
+	return r.Status == RequestStateDone && len(r.pending) == 0
+}
@@ -0,0 +1,67 @@
+package request
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader(t *testing.T) {
+	// Test: Pipelined requests arriving together
+	reader := &chunkReader{
+		data: "GET /first HTTP/1.1\r\nHost: test\r\n\r\n" +
+			"POST /second HTTP/1.1\r\nHost: test\r\nContent-Length: 5\r\n\r\nhello" +
+			"POST /third HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n" +
+			"GET /fourth HTTP/1.1\r\nHost: test\r\n\r\n",
+		numBytesPerRead: 1024,
+	}
+	requests := NewReader(reader, Config{})
+	var targets, bodies []string
+	for {
+		r, err := requests.ReadRequest()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		targets = append(targets, r.RequestLine.RequestTarget)
+		bodies = append(bodies, string(body))
+	}
+	assert.Equal(t, []string{"/first", "/second", "/third", "/fourth"}, targets)
+	assert.Equal(t, []string{"", "hello", "abc", ""}, bodies)
+
+	// Test: Small reads split the requests at arbitrary points
+	reader = &chunkReader{
+		data:            "POST /a HTTP/1.1\r\nContent-Length: 3\r\n\r\nabcGET /b HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 7,
+	}
+	requests = NewReader(reader, Config{})
+	r, err := requests.ReadRequest()
+	require.NoError(t, err)
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(body))
+	r, err = requests.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/b", r.RequestLine.RequestTarget)
+
+	// Test: The previous body has to be consumed first
+	reader = &chunkReader{
+		data:            "POST /a HTTP/1.1\r\nContent-Length: 3\r\n\r\nabcGET /b HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 1024,
+	}
+	requests = NewReader(reader, Config{})
+	r, err = requests.ReadRequest()
+	require.NoError(t, err)
+	_, err = requests.ReadRequest()
+	require.ErrorIs(t, err, ERROR_BODY_NOT_CONSUMED)
+	require.NoError(t, r.DiscardBody(1024))
+	assert.Greater(t, requests.Buffered(), 0)
+	r, err = requests.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/b", r.RequestLine.RequestTarget)
+	assert.Equal(t, 0, requests.Buffered())
+}
@@ -1,6 +1,9 @@
 package request
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -15,22 +18,77 @@ type Status int
 type Request struct {
 	RequestLine RequestLine
 	Status      Status
-	Headers     headers.Headers
-	Body        []byte
+	Headers     *headers.Headers
+	// Body streams the request body from the connection, decoding chunked framing. It is never nil and returns io.EOF straight away when there is no body.
+	Body io.ReadCloser
+	// Trailer fields sent after the last chunk of a chunked body, kept apart from Headers since they arrive after the handler could act on them.
+	// They are only populated once Body has been read to the end.
+	Trailers *headers.Headers
+	// PathParams holds the values captured by the matched route's pattern, it is set by the router
+	PathParams map[string]string
+	// TLS describes the connection the request arrived on, including the server name sent by the client, the negotiated cipher suite and any client certificates.
+	// It is set by the server and is nil for plain connections.
+	TLS *tls.ConnectionState
+	// the length declared by Content-Length, only used when the body isn't chunked
+	contentLength int
+	// bytes left to read in the current chunk of a chunked body
+	chunkRemaining int
+	// body bytes read so far and the decoded ones the handler hasn't read yet
+	bodyRead int
+	pending  []byte
+	body     *bodyReader
+	ctx      context.Context
+	// running totals for the header (and trailer) section, checked against the limits in config
+	headerBytes int
+	headerCount int
+	// bytes of the message parsed so far, it locates where a ParseError happened
+	offset int
+	config Config
+}
+
+// Config holds the optional settings used while parsing a request. A limit that isn't positive means there is no limit.
+type Config struct {
+	// MaxRequestLineLength is the longest request line accepted, not counting the CRLF
+	MaxRequestLineLength int
+	// MaxHeaderBytes limits the size of the header section, and separately the trailer section
+	MaxHeaderBytes int
+	// MaxHeaderCount limits the number of field lines in the header section, and separately the trailer section
+	MaxHeaderCount int
+	// MaxBodySize is the largest body accepted, a larger Content-Length is rejected before any of the body is read
+	MaxBodySize int
+	// ObsFold decides whether folded field values are rejected, the default, or unfolded with a space
+	ObsFold headers.ObsFoldPolicy
+	// OnHeadersDone is called once the header section has been parsed, before any of the body is read
+	OnHeadersDone func()
+}
+
+// exceeds() reports whether value is over a limit, limits that aren't positive are disabled
+func exceeds(value, limit int) bool {
+	return limit > 0 && value > limit
 }
 
 const (
-	RequestStateInitialized    Status = iota // 0
-	RequestStateDone                         // 1
-	RequestStateParsingHeaders               // 2
-	RequestStateParsingBody                  // 3
+	RequestStateInitialized         Status = iota // 0
+	RequestStateDone                              // 1
+	RequestStateParsingHeaders                    // 2
+	RequestStateParsingBody                       // 3
+	RequestStateParsingChunkSize                  // 4
+	RequestStateParsingChunkData                  // 5
+	RequestStateParsingChunkDataEnd               // 6
+	RequestStateParsingTrailers                   // 7
+)
+const (
+	bufferSize = 8
+	// the body is usually larger than the header section so it is read in bigger pieces
+	bodyBufferSize = 4096
 )
-const bufferSize = 8
 
 type RequestLine struct {
-	HttpVersion   string
-	Method        string
+	HttpVersion string
+	Method      string
+	// RequestTarget is the target exactly as it was sent, URL holds the parsed and normalized version
 	RequestTarget string
+	URL           URL
 }
 type chunkReader struct {
 	data            string
@@ -39,9 +97,34 @@ type chunkReader struct {
 }
 
 var (
-	ERROR_MALFORMED_START_LINE  = fmt.Errorf("Malformed Start Line")
-	ERROR_INCOMPLETE_START_LINE = fmt.Errorf("The Start Line is incomplete")
+	ERROR_MALFORMED_START_LINE     = fmt.Errorf("Malformed Start Line")
+	ERROR_INCOMPLETE_START_LINE    = fmt.Errorf("The Start Line is incomplete")
+	ERROR_UNSUPPORTED_HTTP_VERSION = fmt.Errorf("the HTTP version is not supported")
+	ERROR_INCOMPLETE_HEADERS       = fmt.Errorf("incomplete request: the header section is not complete")
+	// RFC 9112 section 6.1: a message with both headers is a request smuggling vector so it is rejected outright
+	ERROR_CONFLICTING_FRAMING           = fmt.Errorf("the request has both a Content-Length and a Transfer-Encoding header")
+	ERROR_UNSUPPORTED_TRANSFER_ENCODING = fmt.Errorf("unsupported Transfer-Encoding , only chunked is accepted")
+	// chunked has to be the last coding and can only be applied once, otherwise the length of the request is ambiguous
+	ERROR_INVALID_TRANSFER_ENCODING = fmt.Errorf("the Transfer-Encoding is malformed , chunked must be the final coding")
+	// Content-Length must be a plain decimal number, signs and whitespace inside the value are how parsers get to disagree on it
+	ERROR_INVALID_CONTENT_LENGTH = fmt.Errorf("the Content-Length is not a valid number")
+	// repeated Content-Length values are only accepted when they are all the same
+	ERROR_CONFLICTING_CONTENT_LENGTH = fmt.Errorf("the request has several different Content-Length values")
+	// "Host : x" is rejected rather than trimmed since a proxy in front might read it differently
+	ERROR_WHITESPACE_BEFORE_COLON = headers.ERROR_INVALID_FIELD_NAME
+	ERROR_INVALID_CHUNK_SIZE      = fmt.Errorf("the chunk size is not a valid hexadecimal number")
+	ERROR_MALFORMED_CHUNK         = fmt.Errorf("the chunk data is not terminated by CRLF")
+	ERROR_REQUEST_LINE_TOO_LONG   = fmt.Errorf("the request line is too long")
+	ERROR_HEADERS_TOO_LARGE       = fmt.Errorf("the header section is too large")
+	ERROR_BODY_TOO_LARGE          = fmt.Errorf("the request body is too large")
+	ERROR_BODY_CLOSED             = fmt.Errorf("read on a closed request body")
+	ERROR_BODY_NOT_DRAINED        = fmt.Errorf("the unread request body is larger than the discard limit")
+	ERROR_BODY_NOT_CONSUMED       = fmt.Errorf("the body of the previous request has not been read to the end")
 )
+
+// The chunk size line only holds a number and optional extensions so it is never allowed to grow the buffer much
+const maxChunkSizeLineLength = 4096
+
 var separator = "\r\n"
 
 func (ch *chunkReader) Read(data []byte) (numBytes int, err error) {
@@ -61,16 +144,39 @@ func (ch *chunkReader) Read(data []byte) (numBytes int, err error) {
 }
 
 func RequestFromReader(r io.Reader) (*Request, error) {
-	buf := make([]byte, bufferSize, bufferSize)
+	return RequestFromReaderWithConfig(r, Config{})
+}
+
+// Same as RequestFromReader() but with custom settings.
+// Only the request line and headers are read, the body is left on r and streamed through Request.Body.
+// Anything read past the end of the request is lost, use a Reader to parse several requests from the same connection.
+func RequestFromReaderWithConfig(r io.Reader, config Config) (*Request, error) {
+	return requestFromReader(r, nil, config)
+}
+
+// requestFromReader() parses a request that starts with the leftover bytes of the previous one and continues on r
+func requestFromReader(r io.Reader, leftover []byte, config Config) (*Request, error) {
+	buf := make([]byte, max(bufferSize, len(leftover)))
 	var (
-		readToIndex int = 0
+		readToIndex int = copy(buf, leftover)
 		bytesParsed int = 0
 	)
 	request := &Request{
-		Status:  RequestStateInitialized,
-		Headers: make(map[string]string),
+		Status:   RequestStateInitialized,
+		Headers:  headers.NewHeaders(),
+		Trailers: headers.NewHeaders(),
+		config:   config,
 	}
-	for {
+	// the leftover may already hold the whole header section
+	if readToIndex > 0 {
+		bytesParsed, err := request.parse(buf[:readToIndex])
+		if err != nil {
+			return nil, err
+		}
+		copy(buf, buf[bytesParsed:readToIndex])
+		readToIndex -= bytesParsed
+	}
+	for request.inHeaderSection() {
 		// Doubles the buffer size and copies the old content
 		if readToIndex == len(buf) {
 			// log.Println("The buffer is full, allocating more space")
@@ -84,6 +190,10 @@ func RequestFromReader(r io.Reader) (*Request, error) {
 		if err != nil {
 			// if at the end of the file
 			if errors.Is(err, io.EOF) {
+				// The peer closed the connection before sending anything, this is how an idle keep-alive connection ends
+				if readToIndex == 0 && request.Status == RequestStateInitialized {
+					return nil, io.EOF
+				}
 				// Parse remaining data before marking as Done
 				if readToIndex > 0 {
 					bytesParsed, parseErr := request.parse(buf[:readToIndex])
@@ -92,9 +202,9 @@ func RequestFromReader(r io.Reader) (*Request, error) {
 					}
 					readToIndex -= bytesParsed
 				}
-				// Only mark as Done if a full request has been parsed
-				if request.Status != RequestStateDone {
-					return nil, fmt.Errorf("incomplete request: no complete request line found")
+				// Only hand the request over if the header section is complete, a truncated body is reported by Body
+				if request.inHeaderSection() {
+					return nil, request.parseError(ERROR_INCOMPLETE_HEADERS, 0)
 				}
 				break
 			}
@@ -109,26 +219,54 @@ func RequestFromReader(r io.Reader) (*Request, error) {
 		// shift the remaining data to the front
 		copy(buf, buf[bytesParsed:readToIndex])
 		readToIndex -= bytesParsed
-
-		// Break when request is complete
-		if request.Status == RequestStateDone {
-			break
-		}
 	}
+	// whatever was read past the headers belongs to the body
+	request.body = newBodyReader(request, r, buf[:readToIndex])
+	request.Body = request.body
 	return request, nil
 }
 
+func (r *Request) inHeaderSection() bool {
+	return r.Status == RequestStateInitialized || r.Status == RequestStateParsingHeaders
+}
+
+// Context() returns the request's context. The server cancels it when the client disconnects, the server shuts down or the handler timeout expires.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext() returns a shallow copy of r that uses ctx, the copy shares the body with r. Middlewares use it to attach values for the handlers they wrap.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := new(Request)
+	*r2 = *r
+	r2.ctx = ctx
+	return r2
+}
+
+// PathValue() returns the value captured for a named parameter in the matched route, or an empty string if there is none
+func (r *Request) PathValue(name string) string {
+	return r.PathParams[name]
+}
+
 // parse() accepts the next slice of bytes that needs to be parsed into the Request struct
 // It returns the number of bytes it consumed (meaning successfully parsed) and an error if it encountered one.
 func (r *Request) parse(data []byte) (int, error) {
 	totalBytesParsed := 0
 	for r.Status != RequestStateDone {
+		previousStatus := r.Status
 		n, err := r.parseSingle(data[totalBytesParsed:])
 		if err != nil {
-			return 0, err
+			return 0, r.parseError(err, n)
 		}
+		r.offset += n
 		// If no progress was made, we need more data - exit the loop
-		if n == 0 {
+		if n == 0 && r.Status == previousStatus {
 			break
 		}
 		totalBytesParsed += n
@@ -148,45 +286,48 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		err = fmt.Errorf("error:trying to read data in a done state")
 	case RequestStateInitialized:
 		requestLine, _, requestLineBytesParsed, parseError := parseRequestLine(string(data))
+		// reject an overly long line before it is complete so the buffer can't grow without bound
+		if (requestLineBytesParsed == 0 && exceeds(len(data), r.config.MaxRequestLineLength)) ||
+			exceeds(requestLineBytesParsed-len(separator), r.config.MaxRequestLineLength) {
+			err = ERROR_REQUEST_LINE_TOO_LONG
+			break
+		}
 		// more content is needed before parsing the req line
 		if requestLineBytesParsed == 0 {
 			break
 		}
+		if parseError != nil {
+			err = parseError
+			break
+		}
 		// update status and the requestLine
 		r.Status = RequestStateParsingHeaders
 		r.RequestLine = *requestLine
 
 		parsedLength += requestLineBytesParsed
-
-		err = parseError
 	case RequestStateParsingHeaders:
-		headersLength, done, parseError := r.Headers.Parse(data)
+		headersLength, done, parseError := r.Headers.ParseWithConfig(data, headers.ParseConfig{ObsFold: r.config.ObsFold})
 		parsedLength += headersLength
 
 		if parseError != nil {
 			err = parseError
 			break
 		}
-		if done {
-			r.Status = RequestStateParsingBody
-		}
-	case RequestStateParsingBody:
-		contentLength := r.Headers.Get("Content-Length")
-		// Move to the done state since there's no  request body to parse
-		if contentLength == "" {
-			r.Status = RequestStateDone
-			break
-		}
-		expectedLength, conversionErr := strconv.Atoi(contentLength)
-		if conversionErr != nil {
-			err = conversionErr
+		if err = r.checkFieldLimits(data, headersLength, done); err != nil {
 			break
 		}
-		if expectedLength < 0 {
-			err = fmt.Errorf("invalid Content-Length: cannot be negative")
-			break
+		if done {
+			// the framing is settled before the body so a bad one is reported as a header error
+			if err = r.startBody(); err != nil {
+				break
+			}
+			if r.config.OnHeadersDone != nil {
+				r.config.OnHeadersDone()
+			}
 		}
-		currentBodyLength := len(r.Body)
+	case RequestStateParsingBody:
+		expectedLength := r.contentLength
+		currentBodyLength := r.bodyRead
 		remainingBodyNeeded := expectedLength - currentBodyLength
 		if remainingBodyNeeded <= 0 {
 			if remainingBodyNeeded < 0 {
@@ -204,16 +345,80 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		if availableData < remainingBodyNeeded {
 			dataToConsume = availableData
 		}
-		// Append the data to the body
-		r.Body = append(r.Body, data[:dataToConsume]...)
+		// Hand the data to the body reader
+		r.pending = append(r.pending, data[:dataToConsume]...)
+		r.bodyRead += dataToConsume
 		parsedLength += dataToConsume
 
 		// Terminate if the body is complete
-		if len(r.Body) == expectedLength {
+		if r.bodyRead == expectedLength {
 			r.Status = RequestStateDone
-		} else if len(r.Body) > expectedLength {
+		} else if r.bodyRead > expectedLength {
 			//  safety check
-			err = fmt.Errorf("body length (%d) exceeds Content-Length (%d)", len(r.Body), expectedLength)
+			err = fmt.Errorf("body length (%d) exceeds Content-Length (%d)", r.bodyRead, expectedLength)
+		}
+	case RequestStateParsingChunkSize:
+		idx := bytes.Index(data, []byte(separator))
+		if (idx == -1 && len(data) > maxChunkSizeLineLength) || idx > maxChunkSizeLineLength {
+			err = ERROR_INVALID_CHUNK_SIZE
+			break
+		}
+		// the chunk size line is incomplete
+		if idx == -1 {
+			break
+		}
+		chunkSize, parseError := parseChunkSize(data[:idx])
+		if parseError != nil {
+			err = parseError
+			break
+		}
+		// compared without adding since a huge chunk size would overflow the sum
+		if r.config.MaxBodySize > 0 && chunkSize > r.config.MaxBodySize-r.bodyRead {
+			err = ERROR_BODY_TOO_LARGE
+			break
+		}
+		parsedLength += idx + len(separator)
+		// the last chunk has a size of zero and is followed by the (optional) trailer section
+		if chunkSize == 0 {
+			r.Status = RequestStateParsingTrailers
+			// the trailer section gets its own budget
+			r.headerBytes, r.headerCount = 0, 0
+			break
+		}
+		r.chunkRemaining = chunkSize
+		r.Status = RequestStateParsingChunkData
+	case RequestStateParsingChunkData:
+		dataToConsume := min(len(data), r.chunkRemaining)
+		r.pending = append(r.pending, data[:dataToConsume]...)
+		r.bodyRead += dataToConsume
+		r.chunkRemaining -= dataToConsume
+		parsedLength += dataToConsume
+		if r.chunkRemaining == 0 {
+			r.Status = RequestStateParsingChunkDataEnd
+		}
+	case RequestStateParsingChunkDataEnd:
+		if len(data) < len(separator) {
+			break
+		}
+		if !bytes.HasPrefix(data, []byte(separator)) {
+			err = ERROR_MALFORMED_CHUNK
+			break
+		}
+		parsedLength += len(separator)
+		r.Status = RequestStateParsingChunkSize
+	case RequestStateParsingTrailers:
+		// the trailer section uses the same syntax as the header section
+		trailersLength, done, parseError := r.Trailers.ParseWithConfig(data, headers.ParseConfig{ObsFold: r.config.ObsFold})
+		parsedLength += trailersLength
+		if parseError != nil {
+			err = parseError
+			break
+		}
+		if err = r.checkFieldLimits(data, trailersLength, done); err != nil {
+			break
+		}
+		if done {
+			r.Status = RequestStateDone
 		}
 	default:
 		err = fmt.Errorf("invalid state")
@@ -222,6 +427,126 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 	return parsedLength, err
 }
 
+// checkFieldLimits() adds the field lines consumed by the last call to Headers.Parse() to the running totals and checks them against the limits.
+// Data that couldn't be parsed yet is counted too so a single endless line is caught early.
+func (r *Request) checkFieldLimits(data []byte, consumed int, done bool) error {
+	lines := bytes.Count(data[:consumed], []byte(separator))
+	// the empty line that ends the section isn't a field
+	if done {
+		lines--
+	}
+	r.headerBytes += consumed
+	r.headerCount += lines
+	pending := 0
+	if !done {
+		pending = len(data) - consumed
+	}
+	if exceeds(r.headerBytes+pending, r.config.MaxHeaderBytes) || exceeds(r.headerCount, r.config.MaxHeaderCount) {
+		return ERROR_HEADERS_TOO_LARGE
+	}
+	return nil
+}
+
+// startBody() picks how the body is framed from the headers and moves to the matching state
+func (r *Request) startBody() error {
+	if transferEncoding, ok := r.Headers.Lookup("transfer-encoding"); ok {
+		if _, ok := r.Headers.Lookup("content-length"); ok {
+			return ERROR_CONFLICTING_FRAMING
+		}
+		// RFC 9112 section 6.1: chunked didn't exist in HTTP/1.0 so a 1.0 request that claims it can't be trusted
+		if r.RequestLine.HttpVersion == "1.0" {
+			return ERROR_INVALID_TRANSFER_ENCODING
+		}
+		if err := checkTransferEncoding(transferEncoding); err != nil {
+			return err
+		}
+		r.Status = RequestStateParsingChunkSize
+		return nil
+	}
+	contentLengths := r.Headers.Values("content-length")
+	// Move to the done state since there's no  request body to parse
+	if contentLengths == nil {
+		r.Status = RequestStateDone
+		return nil
+	}
+	expectedLength, err := parseContentLength(contentLengths)
+	if err != nil {
+		return err
+	}
+	if exceeds(expectedLength, r.config.MaxBodySize) {
+		return ERROR_BODY_TOO_LARGE
+	}
+	r.contentLength = expectedLength
+	r.Status = RequestStateParsingBody
+	return nil
+}
+
+// checkTransferEncoding() only accepts a coding list that is exactly "chunked".
+// A list where chunked isn't the last coding or appears twice is malformed, any other list names a coding this server can't decode.
+func checkTransferEncoding(value string) error {
+	codings := strings.Split(value, ",")
+	for i, coding := range codings {
+		coding = strings.Trim(coding, " \t")
+		if coding == "" {
+			return ERROR_INVALID_TRANSFER_ENCODING
+		}
+		if strings.EqualFold(coding, "chunked") && i != len(codings)-1 {
+			return ERROR_INVALID_TRANSFER_ENCODING
+		}
+		codings[i] = coding
+	}
+	if len(codings) > 1 || !strings.EqualFold(codings[0], "chunked") {
+		return ERROR_UNSUPPORTED_TRANSFER_ENCODING
+	}
+	return nil
+}
+
+// parseContentLength() reads the Content-Length from every value of the field, each value can itself be a comma separated list.
+// RFC 9110 section 8.6 allows a list of identical values to be read as a single one, anything else is rejected.
+func parseContentLength(values []string) (int, error) {
+	length := -1
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			element = strings.Trim(element, " \t")
+			// at most 18 digits keeps the number within an int64
+			if element == "" || len(element) > 18 || strings.Trim(element, "0123456789") != "" {
+				return 0, ERROR_INVALID_CONTENT_LENGTH
+			}
+			n, _ := strconv.Atoi(element)
+			if length != -1 && n != length {
+				return 0, ERROR_CONFLICTING_CONTENT_LENGTH
+			}
+			length = n
+		}
+	}
+	return length, nil
+}
+
+// parseChunkSize() parses a chunk size line ( without the CRLF ), chunk extensions are ignored
+func parseChunkSize(line []byte) (int, error) {
+	sizeField, extensions, _ := bytes.Cut(line, []byte(";"))
+	// whitespace is allowed before the extensions
+	sizeField = bytes.TrimRight(sizeField, " \t")
+	// only hex digits are allowed, ParseUint() alone would also accept an underscore or a sign in some forms
+	if len(sizeField) == 0 || len(bytes.Trim(sizeField, "0123456789abcdefABCDEF")) > 0 {
+		return 0, ERROR_INVALID_CHUNK_SIZE
+	}
+	// a bare LF hidden in an extension could end the line early for another parser
+	if !headers.ValidFieldValue(string(extensions)) {
+		return 0, ERROR_INVALID_CHUNK_SIZE
+	}
+	chunkSize, err := strconv.ParseUint(string(sizeField), 16, 63)
+	if err != nil {
+		return 0, ERROR_INVALID_CHUNK_SIZE
+	}
+	return int(chunkSize), nil
+}
+
+// validHttpVersion() checks the DIGIT "." DIGIT form of the version number
+func validHttpVersion(version string) bool {
+	return len(version) == 3 && version[0] >= '0' && version[0] <= '9' && version[1] == '.' && version[2] >= '0' && version[2] <= '9'
+}
+
 func parseRequestLine(s string) (*RequestLine, string, int, error) {
 	idx := strings.Index(s, separator)
 	// If there are no occurences of the separator in s do an early return
@@ -240,13 +565,22 @@ func parseRequestLine(s string) (*RequestLine, string, int, error) {
 	restOfMessage := s[idx+len(separator):]
 	httpParts := strings.Split(parts[2], "/")
 	// fmt.Println("HTTP Parts=>", httpParts)
-	if len(httpParts) != 2 || httpParts[0] != "HTTP" || httpParts[1] != "1.1" {
+	if len(httpParts) != 2 || httpParts[0] != "HTTP" || !validHttpVersion(httpParts[1]) {
 		return nil, restOfMessage, lengthParsed, ERROR_MALFORMED_START_LINE
 	}
+	// a well formed version this server doesn't speak gets a 505 instead of a 400
+	if httpParts[1] != "1.1" && httpParts[1] != "1.0" {
+		return nil, restOfMessage, lengthParsed, ERROR_UNSUPPORTED_HTTP_VERSION
+	}
+	target, err := ParseRequestTarget(parts[0], parts[1])
+	if err != nil {
+		return nil, restOfMessage, lengthParsed, err
+	}
 
 	return &RequestLine{
 		Method:        parts[0],
 		RequestTarget: parts[1],
+		URL:           target,
 		HttpVersion:   httpParts[1],
 	}, restOfMessage, lengthParsed, nil
 }
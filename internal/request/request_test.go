@@ -1,12 +1,29 @@
 package request
 
 import (
+	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/mbeka02/go_http/internal/headers"
 )
 
+// readRequest parses a request and reads its whole body, returning the first error from either step
+func readRequest(reader io.Reader, config Config) (*Request, []byte, error) {
+	r, err := RequestFromReaderWithConfig(reader, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r, body, nil
+}
+
 func TestRequestBody(t *testing.T) {
 	// Test: Standard Body
 	reader := &chunkReader{
@@ -17,10 +34,10 @@ func TestRequestBody(t *testing.T) {
 			"hello world!\n",
 		numBytesPerRead: 3,
 	}
-	r, err := RequestFromReader(reader)
+	r, body, err := readRequest(reader, Config{})
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "hello world!\n", string(r.Body))
+	assert.Equal(t, "hello world!\n", string(body))
 
 	// Test: Body shorter than reported content length
 	reader = &chunkReader{
@@ -31,7 +48,7 @@ func TestRequestBody(t *testing.T) {
 			"partial content",
 		numBytesPerRead: 3,
 	}
-	r, err = RequestFromReader(reader)
+	r, body, err = readRequest(reader, Config{})
 	require.Error(t, err)
 	// Test : Empty Body, 0 reported content length
 	reader = &chunkReader{
@@ -42,7 +59,7 @@ func TestRequestBody(t *testing.T) {
 			"",
 		numBytesPerRead: 3,
 	}
-	r, err = RequestFromReader(reader)
+	r, body, err = readRequest(reader, Config{})
 	require.NoError(t, err)
 
 	// Test : Empty Body, no reported content length
@@ -53,7 +70,7 @@ func TestRequestBody(t *testing.T) {
 			"",
 		numBytesPerRead: 3,
 	}
-	r, err = RequestFromReader(reader)
+	r, body, err = readRequest(reader, Config{})
 	require.NoError(t, err)
 }
 
@@ -103,6 +120,30 @@ func TestRequestHeaders(t *testing.T) {
 	}
 	r, err = RequestFromReader(reader)
 	require.Error(t, err)
+	// Test: Folded header value is rejected by default
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nX-Long: first\r\n\tsecond\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, headers.ERROR_OBS_FOLD)
+
+	// Test: Folded header value is unfolded when configured
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nX-Long: first\r\n\tsecond\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReaderWithConfig(reader, Config{ObsFold: headers.ObsFoldReplace})
+	require.NoError(t, err)
+	assert.Equal(t, "first second", r.Headers.Get("x-long"))
+
+	// Test: Bare CR in a header value
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: local\rhost\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, headers.ERROR_INVALID_FIELD_VALUE)
 }
 
 func TestRequestLine(t *testing.T) {
@@ -130,3 +171,424 @@ func TestRequestLine(t *testing.T) {
 	assert.Equal(t, "/coffee", r.RequestLine.RequestTarget)
 	assert.Equal(t, "1.1", r.RequestLine.HttpVersion)
 }
+
+func TestRequestHTTP10(t *testing.T) {
+	// Test: HTTP/1.0 request line
+	reader := &chunkReader{
+		data:            "GET /status HTTP/1.0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+
+	// Test: HTTP/1.0 with a Content-Length body
+	reader = &chunkReader{
+		data:            "POST /submit HTTP/1.0\r\nContent-Length: 5\r\n\r\nhello",
+		numBytesPerRead: 3,
+	}
+	_, body, err := readRequest(reader, Config{})
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	// Test: Chunked framing in an HTTP/1.0 request
+	reader = &chunkReader{
+		data:            "POST /submit HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, _, err = readRequest(reader, Config{})
+	require.ErrorIs(t, err, ERROR_INVALID_TRANSFER_ENCODING)
+
+	// Test: Unknown versions
+	for _, version := range []string{"HTTP/0.9", "HTTP/1.2", "HTTP/2.0"} {
+		reader = &chunkReader{
+			data:            "GET / " + version + "\r\n\r\n",
+			numBytesPerRead: 3,
+		}
+		_, err = RequestFromReader(reader)
+		require.ErrorIs(t, err, ERROR_UNSUPPORTED_HTTP_VERSION, version)
+	}
+}
+
+func TestRequestEmptyConnection(t *testing.T) {
+	// Test: Connection closed before any data was sent
+	reader := &chunkReader{
+		data:            "",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.ErrorIs(t, err, io.EOF)
+	assert.Nil(t, r)
+
+	// Test: Connection closed part way through the request line
+	reader = &chunkReader{
+		data:            "GET / HT",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, io.EOF)
+}
+
+func TestRequestChunkedBody(t *testing.T) {
+	// Test: Standard chunked body
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"6\r\nhello \r\n" +
+			"7\r\nworld!\n\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, body, err := readRequest(reader, Config{})
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello world!\n", string(body))
+
+	// Test: Chunk extensions, upper case hex digits and a trailer section
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"A;name=value\r\n0123456789\r\n" +
+			"1 ; ext\r\n!\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc\r\n" +
+			"\r\n",
+		numBytesPerRead: 5,
+	}
+	r, body, err = readRequest(reader, Config{})
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "0123456789!", string(body))
+	assert.Equal(t, "abc", r.Trailers.Get("x-checksum"))
+
+	// Test: Invalid chunk size
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"zz\r\nhello\r\n" +
+			"0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, _, err = readRequest(reader, Config{})
+	require.ErrorIs(t, err, ERROR_INVALID_CHUNK_SIZE)
+
+	// Test: Chunk data longer than its size
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"3\r\nhello\r\n" +
+			"0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, _, err = readRequest(reader, Config{})
+	require.ErrorIs(t, err, ERROR_MALFORMED_CHUNK)
+
+	// Test: Missing terminating chunk
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n",
+		numBytesPerRead: 3,
+	}
+	_, _, err = readRequest(reader, Config{})
+	require.Error(t, err)
+
+	// Test: Both Content-Length and Transfer-Encoding
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Content-Length: 5\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n" +
+			"0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, _, err = readRequest(reader, Config{})
+	require.ErrorIs(t, err, ERROR_CONFLICTING_FRAMING)
+
+	// Test: Unsupported transfer coding
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: gzip\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	_, _, err = readRequest(reader, Config{})
+	require.ErrorIs(t, err, ERROR_UNSUPPORTED_TRANSFER_ENCODING)
+}
+
+func TestRequestTrailers(t *testing.T) {
+	// Test: Multiple trailer fields
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Trailer: X-Content-SHA256, X-Content-Length\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n" +
+			"0\r\n" +
+			"X-Content-SHA256: 2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824\r\n" +
+			"X-Content-Length: 5\r\n" +
+			"\r\n",
+		numBytesPerRead: 4,
+	}
+	r, body, err := readRequest(reader, Config{})
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", r.Trailers.Get("x-content-sha256"))
+	assert.Equal(t, "5", r.Trailers.Get("x-content-length"))
+	// trailers are not merged into the headers
+	_, ok := r.Headers.Lookup("x-content-length")
+	assert.False(t, ok)
+
+	// Test: Malformed trailer field
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"0\r\n" +
+			"X-Broken\r\n" +
+			"\r\n",
+		numBytesPerRead: 4,
+	}
+	_, _, err = readRequest(reader, Config{})
+	require.Error(t, err)
+}
+
+func TestRequestTarget(t *testing.T) {
+	// Test: The parsed URL is available on the request line
+	reader := &chunkReader{
+		data:            "GET /coffee/../tea?sugar=2 HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "/coffee/../tea?sugar=2", r.RequestLine.RequestTarget)
+	assert.Equal(t, "/tea", r.RequestLine.URL.Path)
+	assert.Equal(t, "2", r.RequestLine.URL.Query.Get("sugar"))
+
+	// Test: Invalid request target
+	reader = &chunkReader{
+		data:            "GET coffee HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ERROR_INVALID_REQUEST_TARGET)
+
+	// Test: Malformed start line
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1 extra\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ERROR_MALFORMED_START_LINE)
+}
+
+func TestRequestLimits(t *testing.T) {
+	config := Config{
+		MaxRequestLineLength: 32,
+		MaxHeaderBytes:       64,
+		MaxHeaderCount:       3,
+		MaxBodySize:          10,
+	}
+
+	// Test: Everything within the limits
+	reader := &chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 5\r\n\r\nhello",
+		numBytesPerRead: 3,
+	}
+	_, body, err := readRequest(reader, config)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	// Test: Request line too long, caught before the line ends
+	reader = &chunkReader{
+		data:            "GET /" + strings.Repeat("a", 1000) + " HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, _, err = readRequest(reader, config)
+	require.ErrorIs(t, err, ERROR_REQUEST_LINE_TOO_LONG)
+
+	// Test: Header section too large
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nCookie: " + strings.Repeat("a", 100) + "\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, _, err = readRequest(reader, config)
+	require.ErrorIs(t, err, ERROR_HEADERS_TOO_LARGE)
+
+	// Test: Too many header fields, duplicates count separately
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nA: 1\r\nA: 2\r\nA: 3\r\nA: 4\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, _, err = readRequest(reader, config)
+	require.ErrorIs(t, err, ERROR_HEADERS_TOO_LARGE)
+
+	// Test: Content-Length over the limit is rejected without reading the body
+	reader = &chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 1000000\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, _, err = readRequest(reader, config)
+	require.ErrorIs(t, err, ERROR_BODY_TOO_LARGE)
+
+	// Test: Chunked body over the limit
+	reader = &chunkReader{
+		data:            "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n8\r\n12345678\r\n8\r\n12345678\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, _, err = readRequest(reader, config)
+	require.ErrorIs(t, err, ERROR_BODY_TOO_LARGE)
+
+	// Test: A chunk size that would overflow the running total is still over the limit
+	reader = &chunkReader{
+		data:            "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n1\r\na\r\n7fffffffffffffff\r\n" + strings.Repeat("a", 100) + "\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, _, err = readRequest(reader, config)
+	require.ErrorIs(t, err, ERROR_BODY_TOO_LARGE)
+}
+
+func TestRequestBodyStreaming(t *testing.T) {
+	// Test: The request is returned before the body has been sent
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("POST /upload HTTP/1.1\r\nContent-Length: 11\r\n\r\nhello"))
+		pw.Write([]byte(" world"))
+		pw.Close()
+	}()
+	r, err := RequestFromReader(pr)
+	require.NoError(t, err)
+	assert.Equal(t, "/upload", r.RequestLine.URL.Path)
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(body))
+
+	// Test: Reading a closed body fails
+	reader := &chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NoError(t, r.Body.Close())
+	_, err = r.Body.Read(make([]byte, 5))
+	require.ErrorIs(t, err, ERROR_BODY_CLOSED)
+	// the unread body can still be discarded
+	require.NoError(t, r.DiscardBody(1024))
+	assert.Equal(t, RequestStateDone, r.Status)
+
+	// Test: Discarding stops at the limit
+	reader = &chunkReader{
+		data:            "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n400\r\n" + strings.Repeat("a", 1024) + "\r\n0\r\n\r\n",
+		numBytesPerRead: 64,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.ErrorIs(t, r.DiscardBody(100), ERROR_BODY_NOT_DRAINED)
+
+	// Test: Discarding a truncated body reports the error
+	reader = &chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 50\r\n\r\nshort",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.ErrorIs(t, r.DiscardBody(1024), io.ErrUnexpectedEOF)
+}
+
+func TestRequestSmuggling(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers string
+		body    string
+		err     error
+	}{
+		{"CL and TE", "Content-Length: 5\r\nTransfer-Encoding: chunked\r\n", "5\r\nhello\r\n0\r\n\r\n", ERROR_CONFLICTING_FRAMING},
+		{"TE and CL", "Transfer-Encoding: chunked\r\nContent-Length: 5\r\n", "5\r\nhello\r\n0\r\n\r\n", ERROR_CONFLICTING_FRAMING},
+		{"Different CL fields", "Content-Length: 5\r\nContent-Length: 6\r\n", "hello!", ERROR_CONFLICTING_CONTENT_LENGTH},
+		{"Different CL list", "Content-Length: 5, 6\r\n", "hello!", ERROR_CONFLICTING_CONTENT_LENGTH},
+		{"Signed CL", "Content-Length: +5\r\n", "hello", ERROR_INVALID_CONTENT_LENGTH},
+		{"Negative CL", "Content-Length: -1\r\n", "", ERROR_INVALID_CONTENT_LENGTH},
+		{"Hex CL", "Content-Length: 0x5\r\n", "hello", ERROR_INVALID_CONTENT_LENGTH},
+		{"Space inside CL", "Content-Length: 1 0\r\n", "hello", ERROR_INVALID_CONTENT_LENGTH},
+		{"Empty CL", "Content-Length:\r\n", "", ERROR_INVALID_CONTENT_LENGTH},
+		{"Overflowing CL", "Content-Length: 99999999999999999999\r\n", "", ERROR_INVALID_CONTENT_LENGTH},
+		{"Space before colon", "Content-Length : 5\r\n", "hello", ERROR_WHITESPACE_BEFORE_COLON},
+		{"Tab before colon", "Transfer-Encoding\t: chunked\r\n", "0\r\n\r\n", ERROR_WHITESPACE_BEFORE_COLON},
+		{"Chunked twice", "Transfer-Encoding: chunked, chunked\r\n", "0\r\n\r\n", ERROR_INVALID_TRANSFER_ENCODING},
+		{"Chunked not last", "Transfer-Encoding: chunked\r\nTransfer-Encoding: gzip\r\n", "0\r\n\r\n", ERROR_INVALID_TRANSFER_ENCODING},
+		{"Empty coding", "Transfer-Encoding: , chunked\r\n", "0\r\n\r\n", ERROR_INVALID_TRANSFER_ENCODING},
+		{"Other coding before chunked", "Transfer-Encoding: gzip, chunked\r\n", "0\r\n\r\n", ERROR_UNSUPPORTED_TRANSFER_ENCODING},
+		{"Chunk size with a sign", "Transfer-Encoding: chunked\r\n", "+5\r\nhello\r\n0\r\n\r\n", ERROR_INVALID_CHUNK_SIZE},
+		{"Chunk size with a prefix", "Transfer-Encoding: chunked\r\n", "0x5\r\nhello\r\n0\r\n\r\n", ERROR_INVALID_CHUNK_SIZE},
+		{"Chunk size with an underscore", "Transfer-Encoding: chunked\r\n", "0_5\r\nhello\r\n0\r\n\r\n", ERROR_INVALID_CHUNK_SIZE},
+		{"Overflowing chunk size", "Transfer-Encoding: chunked\r\n", "fffffffffffffffff\r\nhello\r\n0\r\n\r\n", ERROR_INVALID_CHUNK_SIZE},
+		{"Bare LF in a chunk extension", "Transfer-Encoding: chunked\r\n", "5;a\nb\r\nhello\r\n0\r\n\r\n", ERROR_INVALID_CHUNK_SIZE},
+	}
+	for _, tc := range tests {
+		reader := &chunkReader{
+			data:            "POST /submit HTTP/1.1\r\nHost: test\r\n" + tc.headers + "\r\n" + tc.body,
+			numBytesPerRead: 3,
+		}
+		_, _, err := readRequest(reader, Config{})
+		assert.ErrorIs(t, err, tc.err, tc.name)
+	}
+
+	// Test: Identical Content-Length values are read as one
+	for _, fields := range []string{"Content-Length: 5\r\nContent-Length: 5\r\n", "Content-Length: 5, 5\r\n"} {
+		reader := &chunkReader{
+			data:            "POST /submit HTTP/1.1\r\nHost: test\r\n" + fields + "\r\nhello",
+			numBytesPerRead: 3,
+		}
+		_, body, err := readRequest(reader, Config{})
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(body))
+	}
+}
+
+func TestParseError(t *testing.T) {
+	// framing errors are found once the header section is over so they point at its end
+	tests := []struct {
+		data       string
+		config     Config
+		phase      ParsePhase
+		offset     int
+		statusCode int
+		err        error
+	}{
+		{"GET / HTTP/1.1 extra\r\n\r\n", Config{}, ParsePhaseRequestLine, 0, 400, ERROR_MALFORMED_START_LINE},
+		{"GET / HTTP/2.0\r\n\r\n", Config{}, ParsePhaseRequestLine, 0, 505, ERROR_UNSUPPORTED_HTTP_VERSION},
+		{"GET /" + strings.Repeat("a", 20) + " HTTP/1.1\r\n\r\n", Config{MaxRequestLineLength: 16}, ParsePhaseRequestLine, 0, 414, ERROR_REQUEST_LINE_TOO_LONG},
+		{"GET / HTTP/1.1\r\nHost: a\r\nBad Name: b\r\n\r\n", Config{}, ParsePhaseHeaders, 25, 400, headers.ERROR_INVALID_HEADER_KEY},
+		{"GET / HTTP/1.1\r\nHost: a\r\nX: " + strings.Repeat("b", 40) + "\r\n\r\n", Config{MaxHeaderBytes: 32}, ParsePhaseHeaders, 25, 431, ERROR_HEADERS_TOO_LARGE},
+		{"GET / HTTP/1.1\r\nHost: a", Config{}, ParsePhaseHeaders, 16, 400, ERROR_INCOMPLETE_HEADERS},
+		{"POST / HTTP/1.1\r\nContent-Length: 20\r\n\r\n", Config{MaxBodySize: 10}, ParsePhaseHeaders, 39, 413, ERROR_BODY_TOO_LARGE},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n", Config{}, ParsePhaseHeaders, 44, 501, ERROR_UNSUPPORTED_TRANSFER_ENCODING},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\nzz\r\n", Config{}, ParsePhaseBody, 57, 400, ERROR_INVALID_CHUNK_SIZE},
+	}
+	for _, tc := range tests {
+		reader := &chunkReader{
+			data:            tc.data,
+			numBytesPerRead: 3,
+		}
+		_, _, err := readRequest(reader, tc.config)
+		var parseErr *ParseError
+		require.ErrorAs(t, err, &parseErr, tc.data)
+		assert.ErrorIs(t, err, tc.err, tc.data)
+		assert.Equal(t, tc.phase, parseErr.Phase, tc.data)
+		assert.Equal(t, tc.offset, parseErr.Offset, tc.data)
+		assert.Equal(t, tc.statusCode, parseErr.StatusCode, tc.data)
+	}
+}
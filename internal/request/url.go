@@ -0,0 +1,157 @@
+package request
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// TargetForm is one of the four request-target forms from RFC 9112 section 3.2
+type TargetForm int
+
+const (
+	TargetFormOrigin    TargetForm = iota // 0, /path?query
+	TargetFormAbsolute                    // 1, http://host/path?query
+	TargetFormAuthority                   // 2, host:port, only for CONNECT
+	TargetFormAsterisk                    // 3, *, only for OPTIONS
+)
+
+// URL is the parsed request-target. Path is percent-decoded with "." and ".." segments resolved so it is safe to route on.
+type URL struct {
+	Form TargetForm
+	// Scheme and Host are only set for the absolute and authority forms
+	Scheme   string
+	Host     string
+	Path     string
+	RawQuery string
+	Query    url.Values
+}
+
+var (
+	ERROR_INVALID_REQUEST_TARGET = fmt.Errorf("the request target is invalid")
+	ERROR_INVALID_PERCENT_ENCODE = fmt.Errorf("the request target contains an invalid percent encoding")
+)
+
+// ParseRequestTarget() parses the request-target of a request line, the method decides which forms are allowed
+func ParseRequestTarget(method, target string) (URL, error) {
+	if target == "" {
+		return URL{}, ERROR_INVALID_REQUEST_TARGET
+	}
+	// only visible ASCII is allowed and fragments are never sent to a server
+	for i := 0; i < len(target); i++ {
+		if target[i] <= ' ' || target[i] >= 0x7f || target[i] == '#' {
+			return URL{}, ERROR_INVALID_REQUEST_TARGET
+		}
+	}
+	switch {
+	case method == "CONNECT":
+		host, err := parseAuthority(target, true)
+		if err != nil {
+			return URL{}, err
+		}
+		return URL{Form: TargetFormAuthority, Host: host}, nil
+	case target == "*":
+		if method != "OPTIONS" {
+			return URL{}, ERROR_INVALID_REQUEST_TARGET
+		}
+		return URL{Form: TargetFormAsterisk, Path: "*", Query: url.Values{}}, nil
+	case strings.HasPrefix(target, "/"):
+		u := URL{Form: TargetFormOrigin}
+		err := u.setPathAndQuery(target)
+		return u, err
+	default:
+		return parseAbsoluteForm(target)
+	}
+}
+
+func parseAbsoluteForm(target string) (URL, error) {
+	scheme, rest, found := strings.Cut(target, "://")
+	if !found {
+		return URL{}, ERROR_INVALID_REQUEST_TARGET
+	}
+	scheme = strings.ToLower(scheme)
+	if scheme != "http" && scheme != "https" {
+		return URL{}, ERROR_INVALID_REQUEST_TARGET
+	}
+	authorityEnd := strings.IndexAny(rest, "/?")
+	if authorityEnd == -1 {
+		authorityEnd = len(rest)
+	}
+	host, err := parseAuthority(rest[:authorityEnd], false)
+	if err != nil {
+		return URL{}, err
+	}
+	u := URL{Form: TargetFormAbsolute, Scheme: scheme, Host: host}
+	pathAndQuery := rest[authorityEnd:]
+	// an empty path is the same as "/"
+	if !strings.HasPrefix(pathAndQuery, "/") {
+		pathAndQuery = "/" + pathAndQuery
+	}
+	err = u.setPathAndQuery(pathAndQuery)
+	return u, err
+}
+
+// parseAuthority() validates a host with an optional port, CONNECT targets must include the port
+func parseAuthority(authority string, requirePort bool) (string, error) {
+	// userinfo is deprecated for http(s) URIs and a common phishing trick
+	if authority == "" || strings.Contains(authority, "@") {
+		return "", ERROR_INVALID_REQUEST_TARGET
+	}
+	host, port := authority, ""
+	if idx := strings.LastIndex(authority, ":"); idx != -1 && !strings.HasSuffix(authority, "]") {
+		host, port = authority[:idx], authority[idx+1:]
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return "", ERROR_INVALID_REQUEST_TARGET
+		}
+	}
+	if host == "" || (requirePort && port == "") {
+		return "", ERROR_INVALID_REQUEST_TARGET
+	}
+	return strings.ToLower(authority), nil
+}
+
+// setPathAndQuery() decodes and normalizes the path and parses the query string
+func (u *URL) setPathAndQuery(pathAndQuery string) error {
+	rawPath, rawQuery, _ := strings.Cut(pathAndQuery, "?")
+	segments := strings.Split(rawPath[1:], "/")
+	for i, seg := range segments {
+		decoded, err := url.PathUnescape(seg)
+		if err != nil {
+			return ERROR_INVALID_PERCENT_ENCODE
+		}
+		// an encoded slash would turn into an extra segment after the path is joined back up
+		if strings.ContainsAny(decoded, "/\x00") {
+			return ERROR_INVALID_REQUEST_TARGET
+		}
+		segments[i] = decoded
+	}
+	u.Path = "/" + strings.Join(removeDotSegments(segments), "/")
+	u.RawQuery = rawQuery
+	// a malformed pair is skipped rather than failing the whole request, the raw query is still available to the handler
+	u.Query, _ = url.ParseQuery(rawQuery)
+	return nil
+}
+
+// removeDotSegments() resolves "." and ".." like RFC 3986 section 5.2.4 does, ".." can never climb above the root
+func removeDotSegments(segments []string) []string {
+	out := make([]string, 0, len(segments))
+	for i, seg := range segments {
+		isLast := i == len(segments)-1
+		switch seg {
+		case ".":
+		case "..":
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+		default:
+			out = append(out, seg)
+			continue
+		}
+		// a trailing dot segment refers to a directory so it keeps the trailing slash
+		if isLast {
+			out = append(out, "")
+		}
+	}
+	return out
+}
@@ -0,0 +1,82 @@
+package request
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRequestTarget(t *testing.T) {
+	// Test: Origin form with a query string
+	u, err := ParseRequestTarget("GET", "/search?q=go%20http&page=2&tag=a&tag=b")
+	require.NoError(t, err)
+	assert.Equal(t, TargetFormOrigin, u.Form)
+	assert.Equal(t, "/search", u.Path)
+	assert.Equal(t, "q=go%20http&page=2&tag=a&tag=b", u.RawQuery)
+	assert.Equal(t, "go http", u.Query.Get("q"))
+	assert.Equal(t, []string{"a", "b"}, u.Query["tag"])
+
+	// Test: Percent decoding and dot segment normalization
+	u, err = ParseRequestTarget("GET", "/a/./b/../c/%7Euser/%2e%2e/d")
+	require.NoError(t, err)
+	assert.Equal(t, "/a/c/d", u.Path)
+
+	// Test: Dot segments can't climb above the root
+	u, err = ParseRequestTarget("GET", "/../../etc/passwd")
+	require.NoError(t, err)
+	assert.Equal(t, "/etc/passwd", u.Path)
+
+	// Test: A trailing dot segment keeps the trailing slash
+	u, err = ParseRequestTarget("GET", "/a/b/..")
+	require.NoError(t, err)
+	assert.Equal(t, "/a/", u.Path)
+
+	// Test: Absolute form
+	u, err = ParseRequestTarget("GET", "http://Example.com:8080/users/1?x=y")
+	require.NoError(t, err)
+	assert.Equal(t, TargetFormAbsolute, u.Form)
+	assert.Equal(t, "http", u.Scheme)
+	assert.Equal(t, "example.com:8080", u.Host)
+	assert.Equal(t, "/users/1", u.Path)
+	assert.Equal(t, "y", u.Query.Get("x"))
+
+	// Test: Absolute form without a path
+	u, err = ParseRequestTarget("GET", "https://example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "/", u.Path)
+
+	// Test: Authority form
+	u, err = ParseRequestTarget("CONNECT", "example.com:443")
+	require.NoError(t, err)
+	assert.Equal(t, TargetFormAuthority, u.Form)
+	assert.Equal(t, "example.com:443", u.Host)
+
+	// Test: Asterisk form
+	u, err = ParseRequestTarget("OPTIONS", "*")
+	require.NoError(t, err)
+	assert.Equal(t, TargetFormAsterisk, u.Form)
+
+	// Test: Invalid targets
+	invalid := []struct {
+		method string
+		target string
+	}{
+		{"GET", "*"},
+		{"GET", "users"},
+		{"GET", "/page#section"},
+		{"GET", "/bad%zzescape"},
+		{"GET", "/a%2fb"},
+		{"GET", "/nul%00"},
+		{"GET", "ftp://example.com/"},
+		{"GET", "http://user@example.com/"},
+		{"GET", "http:///path"},
+		{"CONNECT", "example.com"},
+		{"CONNECT", "/path"},
+		{"GET", "/caf\xc3\xa9"},
+	}
+	for _, tc := range invalid {
+		_, err = ParseRequestTarget(tc.method, tc.target)
+		assert.Error(t, err, "%s %s", tc.method, tc.target)
+	}
+}
@@ -10,37 +10,186 @@ import (
 	"github.com/mbeka02/go_http/internal/headers"
 )
 
+// StatusCode is the numeric HTTP status code sent in the status line
 type StatusCode int
 
+// The status codes registered with IANA, https://www.iana.org/assignments/http-status-codes
 const (
-	StatusCodeOK StatusCode = iota
-	StatusCodeBadRequest
-	StatusCodeInternalServerError
+	StatusCodeContinue                      StatusCode = 100
+	StatusCodeSwitchingProtocols            StatusCode = 101
+	StatusCodeProcessing                    StatusCode = 102
+	StatusCodeEarlyHints                    StatusCode = 103
+	StatusCodeOK                            StatusCode = 200
+	StatusCodeCreated                       StatusCode = 201
+	StatusCodeAccepted                      StatusCode = 202
+	StatusCodeNonAuthoritativeInformation   StatusCode = 203
+	StatusCodeNoContent                     StatusCode = 204
+	StatusCodeResetContent                  StatusCode = 205
+	StatusCodePartialContent                StatusCode = 206
+	StatusCodeMultiStatus                   StatusCode = 207
+	StatusCodeAlreadyReported               StatusCode = 208
+	StatusCodeIMUsed                        StatusCode = 226
+	StatusCodeMultipleChoices               StatusCode = 300
+	StatusCodeMovedPermanently              StatusCode = 301
+	StatusCodeFound                         StatusCode = 302
+	StatusCodeSeeOther                      StatusCode = 303
+	StatusCodeNotModified                   StatusCode = 304
+	StatusCodeUseProxy                      StatusCode = 305
+	StatusCodeTemporaryRedirect             StatusCode = 307
+	StatusCodePermanentRedirect             StatusCode = 308
+	StatusCodeBadRequest                    StatusCode = 400
+	StatusCodeUnauthorized                  StatusCode = 401
+	StatusCodePaymentRequired               StatusCode = 402
+	StatusCodeForbidden                     StatusCode = 403
+	StatusCodeNotFound                      StatusCode = 404
+	StatusCodeMethodNotAllowed              StatusCode = 405
+	StatusCodeNotAcceptable                 StatusCode = 406
+	StatusCodeProxyAuthenticationRequired   StatusCode = 407
+	StatusCodeRequestTimeout                StatusCode = 408
+	StatusCodeConflict                      StatusCode = 409
+	StatusCodeGone                          StatusCode = 410
+	StatusCodeLengthRequired                StatusCode = 411
+	StatusCodePreconditionFailed            StatusCode = 412
+	StatusCodeContentTooLarge               StatusCode = 413
+	StatusCodeURITooLong                    StatusCode = 414
+	StatusCodeUnsupportedMediaType          StatusCode = 415
+	StatusCodeRangeNotSatisfiable           StatusCode = 416
+	StatusCodeExpectationFailed             StatusCode = 417
+	StatusCodeTeapot                        StatusCode = 418
+	StatusCodeMisdirectedRequest            StatusCode = 421
+	StatusCodeUnprocessableContent          StatusCode = 422
+	StatusCodeLocked                        StatusCode = 423
+	StatusCodeFailedDependency              StatusCode = 424
+	StatusCodeTooEarly                      StatusCode = 425
+	StatusCodeUpgradeRequired               StatusCode = 426
+	StatusCodePreconditionRequired          StatusCode = 428
+	StatusCodeTooManyRequests               StatusCode = 429
+	StatusCodeRequestHeaderFieldsTooLarge   StatusCode = 431
+	StatusCodeUnavailableForLegalReasons    StatusCode = 451
+	StatusCodeInternalServerError           StatusCode = 500
+	StatusCodeNotImplemented                StatusCode = 501
+	StatusCodeBadGateway                    StatusCode = 502
+	StatusCodeServiceUnavailable            StatusCode = 503
+	StatusCodeGatewayTimeout                StatusCode = 504
+	StatusCodeHTTPVersionNotSupported       StatusCode = 505
+	StatusCodeVariantAlsoNegotiates         StatusCode = 506
+	StatusCodeInsufficientStorage           StatusCode = 507
+	StatusCodeLoopDetected                  StatusCode = 508
+	StatusCodeNotExtended                   StatusCode = 510
+	StatusCodeNetworkAuthenticationRequired StatusCode = 511
 )
 
+var (
+	ERROR_INVALID_STATUS_CODE  = fmt.Errorf("the status code must be a three digit number")
+	ERROR_INVALID_HTTP_VERSION = fmt.Errorf("the response can only be HTTP/1.0 or HTTP/1.1")
+)
+
+var reasonPhrases = map[StatusCode]string{
+	StatusCodeContinue:                      "Continue",
+	StatusCodeSwitchingProtocols:            "Switching Protocols",
+	StatusCodeProcessing:                    "Processing",
+	StatusCodeEarlyHints:                    "Early Hints",
+	StatusCodeOK:                            "OK",
+	StatusCodeCreated:                       "Created",
+	StatusCodeAccepted:                      "Accepted",
+	StatusCodeNonAuthoritativeInformation:   "Non-Authoritative Information",
+	StatusCodeNoContent:                     "No Content",
+	StatusCodeResetContent:                  "Reset Content",
+	StatusCodePartialContent:                "Partial Content",
+	StatusCodeMultiStatus:                   "Multi-Status",
+	StatusCodeAlreadyReported:               "Already Reported",
+	StatusCodeIMUsed:                        "IM Used",
+	StatusCodeMultipleChoices:               "Multiple Choices",
+	StatusCodeMovedPermanently:              "Moved Permanently",
+	StatusCodeFound:                         "Found",
+	StatusCodeSeeOther:                      "See Other",
+	StatusCodeNotModified:                   "Not Modified",
+	StatusCodeUseProxy:                      "Use Proxy",
+	StatusCodeTemporaryRedirect:             "Temporary Redirect",
+	StatusCodePermanentRedirect:             "Permanent Redirect",
+	StatusCodeBadRequest:                    "Bad Request",
+	StatusCodeUnauthorized:                  "Unauthorized",
+	StatusCodePaymentRequired:               "Payment Required",
+	StatusCodeForbidden:                     "Forbidden",
+	StatusCodeNotFound:                      "Not Found",
+	StatusCodeMethodNotAllowed:              "Method Not Allowed",
+	StatusCodeNotAcceptable:                 "Not Acceptable",
+	StatusCodeProxyAuthenticationRequired:   "Proxy Authentication Required",
+	StatusCodeRequestTimeout:                "Request Timeout",
+	StatusCodeConflict:                      "Conflict",
+	StatusCodeGone:                          "Gone",
+	StatusCodeLengthRequired:                "Length Required",
+	StatusCodePreconditionFailed:            "Precondition Failed",
+	StatusCodeContentTooLarge:               "Content Too Large",
+	StatusCodeURITooLong:                    "URI Too Long",
+	StatusCodeUnsupportedMediaType:          "Unsupported Media Type",
+	StatusCodeRangeNotSatisfiable:           "Range Not Satisfiable",
+	StatusCodeExpectationFailed:             "Expectation Failed",
+	StatusCodeTeapot:                        "I'm a teapot",
+	StatusCodeMisdirectedRequest:            "Misdirected Request",
+	StatusCodeUnprocessableContent:          "Unprocessable Content",
+	StatusCodeLocked:                        "Locked",
+	StatusCodeFailedDependency:              "Failed Dependency",
+	StatusCodeTooEarly:                      "Too Early",
+	StatusCodeUpgradeRequired:               "Upgrade Required",
+	StatusCodePreconditionRequired:          "Precondition Required",
+	StatusCodeTooManyRequests:               "Too Many Requests",
+	StatusCodeRequestHeaderFieldsTooLarge:   "Request Header Fields Too Large",
+	StatusCodeUnavailableForLegalReasons:    "Unavailable For Legal Reasons",
+	StatusCodeInternalServerError:           "Internal Server Error",
+	StatusCodeNotImplemented:                "Not Implemented",
+	StatusCodeBadGateway:                    "Bad Gateway",
+	StatusCodeServiceUnavailable:            "Service Unavailable",
+	StatusCodeGatewayTimeout:                "Gateway Timeout",
+	StatusCodeHTTPVersionNotSupported:       "HTTP Version Not Supported",
+	StatusCodeVariantAlsoNegotiates:         "Variant Also Negotiates",
+	StatusCodeInsufficientStorage:           "Insufficient Storage",
+	StatusCodeLoopDetected:                  "Loop Detected",
+	StatusCodeNotExtended:                   "Not Extended",
+	StatusCodeNetworkAuthenticationRequired: "Network Authentication Required",
+}
+
+// StatusText() returns the standard reason phrase for a status code, or an empty string if the code isn't registered
+func StatusText(statusCode StatusCode) string {
+	return reasonPhrases[statusCode]
+}
+
+// WriteStatusLine() writes the status line with the standard reason phrase for statusCode.
+// Unregistered codes are written with an empty reason phrase which RFC 9112 allows.
 func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
-	var err error
-	switch statusCode {
-	case StatusCodeOK:
-		n, writeErr := w.Write([]byte("HTTP/1.1 200 OK\r\n"))
-		err = writeErr
-		log.Println("Written:", n, "bytes to the connection")
-	case StatusCodeBadRequest:
-		_, err = w.Write([]byte("HTTP/1.1 400 Bad Request\r\n"))
-	case StatusCodeInternalServerError:
-		_, err = w.Write([]byte("HTTP/1.1 500 Internal Server Errror\r\n"))
-	default:
-		log.Println("unsupported status code , leaving the reason phrase blank")
+	return WriteStatusLineWithReason(w, statusCode, StatusText(statusCode))
+}
+
+// WriteStatusLineWithReason() writes the status line using a custom reason phrase
+func WriteStatusLineWithReason(w io.Writer, statusCode StatusCode, reason string) error {
+	return WriteStatusLineWithVersion(w, "1.1", statusCode, reason)
+}
+
+// WriteStatusLineWithVersion() writes the status line for a response to a request of the given HTTP version, only "1.0" and "1.1" are valid
+func WriteStatusLineWithVersion(w io.Writer, version string, statusCode StatusCode, reason string) error {
+	if statusCode < 100 || statusCode > 999 {
+		return ERROR_INVALID_STATUS_CODE
+	}
+	if version != "1.0" && version != "1.1" {
+		return ERROR_INVALID_HTTP_VERSION
 	}
+	// the reason phrase can't contain line breaks since that would end the status line early
+	reason = strings.NewReplacer("\r", "", "\n", "").Replace(reason)
+	_, err := fmt.Fprintf(w, "HTTP/%s %d %s\r\n", version, statusCode, reason)
 	return err
 }
 
-func WriteHeaders(w io.Writer, headers headers.Headers) error {
+// WriteHeaders() writes the fields followed by the empty line that ends the section.
+// Nothing is written if a name isn't a valid token or a value contains a control character, so a CR or LF can't be used to inject fields.
+func WriteHeaders(w io.Writer, fields *headers.Headers) error {
 	var (
 		builder strings.Builder
 		result  string
 	)
-	for key, value := range headers {
+	if err := ValidateHeaders(fields); err != nil {
+		return err
+	}
+	for key, value := range fields.All() {
 		headerText := fmt.Sprintf("%s:%s\r\n", key, value)
 		builder.WriteString(headerText)
 
@@ -53,11 +202,57 @@ func WriteHeaders(w io.Writer, headers headers.Headers) error {
 	return err
 }
 
-func GetDefaultHeaders(contentLen int) headers.Headers {
+// ValidateHeaders() checks that every field can be written as is, a name or value that could end the field line early is refused
+func ValidateHeaders(fields *headers.Headers) error {
+	for key, value := range fields.All() {
+		if !headers.ValidFieldName(key) {
+			return fmt.Errorf("%w: %q", headers.ERROR_INVALID_HEADER_KEY, key)
+		}
+		if !headers.ValidFieldValue(value) {
+			return fmt.Errorf("%w: %q", headers.ERROR_INVALID_FIELD_VALUE, key)
+		}
+	}
+	return nil
+}
+
+// The Connection header is left to the caller since it depends on whether the connection is kept alive
+func GetDefaultHeaders(contentLen int) *headers.Headers {
 	contentLenStr := strconv.Itoa(contentLen)
 	headers := headers.NewHeaders()
 	headers.Set("Content-Length", contentLenStr)
-	headers.Set("Connection", "close")
 	headers.Set("Content-Type", "text/plain")
 	return headers
 }
+
+// WriteChunkedBody() writes data to w as a single chunk of a "Transfer-Encoding: chunked" body and returns the number of bytes written to w.
+// Empty slices are skipped since a zero sized chunk marks the end of the body.
+func WriteChunkedBody(w io.Writer, data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	total := 0
+	n, err := fmt.Fprintf(w, "%x\r\n", len(data))
+	total += n
+	if err != nil {
+		return total, err
+	}
+	n, err = w.Write(data)
+	total += n
+	if err != nil {
+		return total, err
+	}
+	n, err = w.Write([]byte("\r\n"))
+	total += n
+	return total, err
+}
+
+// WriteChunkedBodyDone() writes the zero sized chunk that terminates a chunked body.
+// It must be followed by WriteTrailers(), even when there are no trailers, to end the message.
+func WriteChunkedBodyDone(w io.Writer) (int, error) {
+	return w.Write([]byte("0\r\n"))
+}
+
+// WriteTrailers() writes the trailer section that follows the last chunk, the fields share the header syntax so an empty list only writes the closing CRLF
+func WriteTrailers(w io.Writer, trailers *headers.Headers) error {
+	return WriteHeaders(w, trailers)
+}
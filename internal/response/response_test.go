@@ -0,0 +1,120 @@
+package response
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mbeka02/go_http/internal/headers"
+)
+
+func TestWriteStatusLine(t *testing.T) {
+	// Test: Registered status codes use the standard reason phrase
+	buf := new(bytes.Buffer)
+	err := WriteStatusLine(buf, StatusCodeOK)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String())
+
+	buf.Reset()
+	err = WriteStatusLine(buf, StatusCodeInternalServerError)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error\r\n", buf.String())
+
+	buf.Reset()
+	err = WriteStatusLine(buf, StatusCodeMethodNotAllowed)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 405 Method Not Allowed\r\n", buf.String())
+
+	// Test: Unregistered status codes have an empty reason phrase
+	buf.Reset()
+	err = WriteStatusLine(buf, 599)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 599 \r\n", buf.String())
+
+	// Test: Custom reason phrase
+	buf.Reset()
+	err = WriteStatusLineWithReason(buf, StatusCodeBadRequest, "Your problem")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 400 Your problem\r\n", buf.String())
+
+	// Test: Line breaks are stripped from custom reason phrases
+	buf.Reset()
+	err = WriteStatusLineWithReason(buf, StatusCodeOK, "OK\r\nX-Injected: yes")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OKX-Injected: yes\r\n", buf.String())
+
+	// Test: HTTP/1.0 status line
+	buf.Reset()
+	err = WriteStatusLineWithVersion(buf, "1.0", StatusCodeOK, "OK")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.0 200 OK\r\n", buf.String())
+
+	// Test: Unsupported response version
+	buf.Reset()
+	err = WriteStatusLineWithVersion(buf, "2.0", StatusCodeOK, "OK")
+	require.ErrorIs(t, err, ERROR_INVALID_HTTP_VERSION)
+	assert.Equal(t, 0, buf.Len())
+
+	// Test: Invalid status codes
+	buf.Reset()
+	err = WriteStatusLine(buf, 42)
+	require.ErrorIs(t, err, ERROR_INVALID_STATUS_CODE)
+	assert.Equal(t, 0, buf.Len())
+}
+
+func TestChunkedBody(t *testing.T) {
+	buf := new(bytes.Buffer)
+	n, err := WriteChunkedBody(buf, []byte("hello world"))
+	require.NoError(t, err)
+	assert.Equal(t, buf.Len(), n)
+	// empty chunks are skipped
+	n, err = WriteChunkedBody(buf, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	_, err = WriteChunkedBodyDone(buf)
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Content-Length", "11")
+	err = WriteTrailers(buf, trailers)
+	require.NoError(t, err)
+	assert.Equal(t, "b\r\nhello world\r\n0\r\nX-Content-Length:11\r\n\r\n", buf.String())
+
+	// Test: The last chunk leaves the message open until the trailer section, even an empty one, ends it
+	buf.Reset()
+	_, err = WriteChunkedBodyDone(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "0\r\n", buf.String())
+	err = WriteTrailers(buf, headers.NewHeaders())
+	require.NoError(t, err)
+	assert.Equal(t, "0\r\n\r\n", buf.String())
+}
+
+func TestWriteHeaders(t *testing.T) {
+	// Test: Fields are written in order with their casing and repeated fields stay on separate lines
+	buf := new(bytes.Buffer)
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/html")
+	h.Add("Set-Cookie", "a=1")
+	h.Add("Set-Cookie", "b=2")
+	h.Set("X-Request-ID", "abc")
+	err := WriteHeaders(buf, h)
+	require.NoError(t, err)
+	assert.Equal(t, "Content-Type:text/html\r\nSet-Cookie:a=1\r\nSet-Cookie:b=2\r\nX-Request-ID:abc\r\n\r\n", buf.String())
+
+	// Test: Line breaks in a value are refused before anything is written
+	buf.Reset()
+	h = headers.NewHeaders()
+	h.Set("Location", "/next\r\nSet-Cookie: injected=1")
+	err = WriteHeaders(buf, h)
+	require.ErrorIs(t, err, headers.ERROR_INVALID_FIELD_VALUE)
+	assert.Equal(t, 0, buf.Len())
+
+	// Test: Invalid field name
+	h = headers.NewHeaders()
+	h.Set("Bad Name", "x")
+	err = WriteHeaders(buf, h)
+	require.ErrorIs(t, err, headers.ERROR_INVALID_HEADER_KEY)
+	assert.Equal(t, 0, buf.Len())
+}
@@ -0,0 +1,243 @@
+package router
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/mbeka02/go_http/internal/request"
+	"github.com/mbeka02/go_http/internal/response"
+	"github.com/mbeka02/go_http/internal/server"
+)
+
+type segmentKind int
+
+const (
+	segmentLiteral  segmentKind = iota // 0
+	segmentParam                       // 1
+	segmentWildcard                    // 2
+)
+
+type segment struct {
+	kind segmentKind
+	// the literal text or the parameter name
+	value string
+}
+
+type route struct {
+	// an empty method matches every method
+	method   string
+	pattern  string
+	segments []segment
+	handler  server.Handler
+}
+
+// Router dispatches requests to handlers by method and path. Use its Route method as the server.Handler passed to server.Serve.
+type Router struct {
+	routes []*route
+}
+
+func New() *Router {
+	return &Router{}
+}
+
+// Handle() registers a handler for a pattern of the form "[METHOD ]/path". Path segments can be literals, "{name}" to capture a single segment,
+// or "{name...}" / "*" as the last segment to capture the rest of the path. It panics if the pattern is invalid or already registered, like http.ServeMux does.
+func (rt *Router) Handle(pattern string, handler server.Handler) {
+	if handler == nil {
+		panic("router: nil handler for " + pattern)
+	}
+	method, path := "", pattern
+	if before, after, found := strings.Cut(pattern, " "); found {
+		method, path = before, strings.TrimLeft(after, " ")
+	}
+	segments, err := parsePattern(path)
+	if err != nil {
+		panic(fmt.Sprintf("router: invalid pattern %q: %v", pattern, err))
+	}
+	newRoute := &route{method: method, pattern: path, segments: segments, handler: handler}
+	for _, existing := range rt.routes {
+		if existing.method == newRoute.method && existing.conflicts(newRoute) {
+			panic(fmt.Sprintf("router: pattern %q conflicts with %q", pattern, strings.TrimSpace(existing.method+" "+existing.pattern)))
+		}
+	}
+	rt.routes = append(rt.routes, newRoute)
+}
+
+// Route() is a server.Handler that runs the most specific route matching the request.
+// Paths without any route get a 404, paths with routes for other methods get a 405 with an Allow header and OPTIONS is answered automatically unless it has its own route.
+// HEAD requests run the GET route when there is no HEAD route for the path, the server leaves out the body.
+func (rt *Router) Route(w server.ResponseWriter, req *request.Request) *server.HandlerError {
+	// "OPTIONS *" asks about the server as a whole, it gets every method a route is registered for
+	if req.RequestLine.URL.Form == request.TargetFormAsterisk {
+		var allowed []string
+		for _, r := range rt.routes {
+			if r.method != "" && !slices.Contains(allowed, r.method) {
+				allowed = append(allowed, r.method)
+			}
+		}
+		setAllow(w, allowed)
+		w.WriteHeader(response.StatusCodeNoContent)
+		return nil
+	}
+	pathSegments := strings.Split(strings.TrimPrefix(req.RequestLine.URL.Path, "/"), "/")
+
+	var (
+		best       *route
+		bestParams map[string]string
+		bestIsGet  bool
+		allowed    []string
+	)
+	method := req.RequestLine.Method
+	for _, candidate := range rt.routes {
+		params, ok := candidate.match(pathSegments)
+		if !ok {
+			continue
+		}
+		if candidate.method != "" && !slices.Contains(allowed, candidate.method) {
+			allowed = append(allowed, candidate.method)
+		}
+		isGet := method == "HEAD" && candidate.method == "GET"
+		if candidate.method != "" && candidate.method != method && !isGet {
+			continue
+		}
+		// a GET route only answers HEAD when nothing registered for HEAD matches
+		switch {
+		case best == nil:
+		case isGet != bestIsGet:
+			if isGet {
+				continue
+			}
+		case !candidate.moreSpecificThan(best):
+			continue
+		}
+		best, bestParams, bestIsGet = candidate, params, isGet
+	}
+
+	if best != nil {
+		req.PathParams = bestParams
+		return best.handler(w, req)
+	}
+	// a route accepting any method would have been picked so only routes for other methods are left
+	if len(allowed) == 0 {
+		return &server.HandlerError{Message: "Not Found\n", StatusCode: response.StatusCodeNotFound}
+	}
+	setAllow(w, allowed)
+	if method == "OPTIONS" {
+		w.WriteHeader(response.StatusCodeNoContent)
+		return nil
+	}
+	w.WriteHeader(response.StatusCodeMethodNotAllowed)
+	w.Write([]byte("Method Not Allowed\n"))
+	return nil
+}
+
+// setAllow() sets the Allow header to the methods with a route, plus the ones the router answers itself
+func setAllow(w server.ResponseWriter, allowed []string) {
+	if slices.Contains(allowed, "GET") && !slices.Contains(allowed, "HEAD") {
+		allowed = append(allowed, "HEAD")
+	}
+	if !slices.Contains(allowed, "OPTIONS") {
+		allowed = append(allowed, "OPTIONS")
+	}
+	slices.Sort(allowed)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+}
+
+func parsePattern(path string) ([]segment, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("the path must start with /")
+	}
+	parts := strings.Split(path[1:], "/")
+	segments := make([]segment, 0, len(parts))
+	for i, part := range parts {
+		isLast := i == len(parts)-1
+		switch {
+		case part == "*":
+			if !isLast {
+				return nil, fmt.Errorf("the wildcard must be the last segment")
+			}
+			segments = append(segments, segment{kind: segmentWildcard, value: "*"})
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "...}"):
+			if !isLast {
+				return nil, fmt.Errorf("the wildcard must be the last segment")
+			}
+			name := strings.TrimSuffix(strings.TrimPrefix(part, "{"), "...}")
+			if name == "" {
+				return nil, fmt.Errorf("the wildcard has no name")
+			}
+			segments = append(segments, segment{kind: segmentWildcard, value: name})
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			name := part[1 : len(part)-1]
+			if name == "" {
+				return nil, fmt.Errorf("the parameter has no name")
+			}
+			segments = append(segments, segment{kind: segmentParam, value: name})
+		case strings.ContainsAny(part, "{}"):
+			return nil, fmt.Errorf("a parameter must take up a whole segment")
+		default:
+			segments = append(segments, segment{kind: segmentLiteral, value: part})
+		}
+	}
+	return segments, nil
+}
+
+// match() reports whether the path matches the route and returns the captured parameters
+func (r *route) match(pathSegments []string) (map[string]string, bool) {
+	params := make(map[string]string)
+	for i, seg := range r.segments {
+		if seg.kind == segmentWildcard {
+			// the wildcard also matches when there is nothing left
+			params[seg.value] = strings.Join(pathSegments[i:], "/")
+			return params, true
+		}
+		if i >= len(pathSegments) {
+			return nil, false
+		}
+		switch seg.kind {
+		case segmentLiteral:
+			if pathSegments[i] != seg.value {
+				return nil, false
+			}
+		case segmentParam:
+			if pathSegments[i] == "" {
+				return nil, false
+			}
+			params[seg.value] = pathSegments[i]
+		}
+	}
+	if len(pathSegments) != len(r.segments) {
+		return nil, false
+	}
+	return params, true
+}
+
+// moreSpecificThan() compares two routes that matched the same path: the first segment that differs decides, literals beat parameters which beat wildcards.
+// A route registered for the request's method beats one that accepts any method.
+func (r *route) moreSpecificThan(other *route) bool {
+	for i := 0; i < len(r.segments) && i < len(other.segments); i++ {
+		if r.segments[i].kind != other.segments[i].kind {
+			return r.segments[i].kind < other.segments[i].kind
+		}
+	}
+	if len(r.segments) != len(other.segments) {
+		return len(r.segments) > len(other.segments)
+	}
+	return r.method != "" && other.method == ""
+}
+
+// conflicts() reports whether two routes have the same shape, parameter names don't matter since they would match exactly the same paths
+func (r *route) conflicts(other *route) bool {
+	if len(r.segments) != len(other.segments) {
+		return false
+	}
+	for i := range r.segments {
+		if r.segments[i].kind != other.segments[i].kind {
+			return false
+		}
+		if r.segments[i].kind == segmentLiteral && r.segments[i].value != other.segments[i].value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,175 @@
+package router
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mbeka02/go_http/internal/headers"
+	"github.com/mbeka02/go_http/internal/request"
+	"github.com/mbeka02/go_http/internal/response"
+	"github.com/mbeka02/go_http/internal/server"
+)
+
+// recorder is a server.ResponseWriter that keeps the response in memory
+type recorder struct {
+	headers    *headers.Headers
+	statusCode response.StatusCode
+	body       bytes.Buffer
+}
+
+func newRecorder() *recorder {
+	return &recorder{headers: headers.NewHeaders(), statusCode: response.StatusCodeOK}
+}
+
+func (rec *recorder) Header() *headers.Headers                   { return rec.headers }
+func (rec *recorder) WriteHeader(statusCode response.StatusCode) { rec.statusCode = statusCode }
+func (rec *recorder) Write(data []byte) (int, error)             { return rec.body.Write(data) }
+func (rec *recorder) Flush()                                     {}
+
+func newRequest(method, target string) *request.Request {
+	url, err := request.ParseRequestTarget(method, target)
+	if err != nil {
+		panic(err)
+	}
+	return &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: target, URL: url, HttpVersion: "1.1"},
+		Headers:     headers.NewHeaders(),
+	}
+}
+
+// respondWith returns a handler that writes name so tests can tell which route ran
+func respondWith(name string) server.Handler {
+	return func(w server.ResponseWriter, req *request.Request) *server.HandlerError {
+		w.Write([]byte(name))
+		return nil
+	}
+}
+
+func TestRouterMatching(t *testing.T) {
+	rt := New()
+	rt.Handle("GET /users", respondWith("list"))
+	rt.Handle("GET /users/{id}", respondWith("show"))
+	rt.Handle("GET /users/me", respondWith("me"))
+	rt.Handle("POST /users", respondWith("create"))
+	rt.Handle("/files/{path...}", respondWith("files"))
+
+	// Test: Literal route
+	rec := newRecorder()
+	handlerErr := rt.Route(rec, newRequest("GET", "/users"))
+	require.Nil(t, handlerErr)
+	assert.Equal(t, "list", rec.body.String())
+
+	// Test: Method selects the route
+	rec = newRecorder()
+	handlerErr = rt.Route(rec, newRequest("POST", "/users"))
+	require.Nil(t, handlerErr)
+	assert.Equal(t, "create", rec.body.String())
+
+	// Test: Path parameter, the query string is ignored
+	req := newRequest("GET", "/users/42?verbose=true")
+	rec = newRecorder()
+	handlerErr = rt.Route(rec, req)
+	require.Nil(t, handlerErr)
+	assert.Equal(t, "show", rec.body.String())
+	assert.Equal(t, "42", req.PathValue("id"))
+
+	// Test: Literal segments beat parameters
+	rec = newRecorder()
+	handlerErr = rt.Route(rec, newRequest("GET", "/users/me"))
+	require.Nil(t, handlerErr)
+	assert.Equal(t, "me", rec.body.String())
+
+	// Test: Wildcard captures the rest of the path for any method
+	req = newRequest("DELETE", "/files/a/b/c.txt")
+	rec = newRecorder()
+	handlerErr = rt.Route(rec, req)
+	require.Nil(t, handlerErr)
+	assert.Equal(t, "files", rec.body.String())
+	assert.Equal(t, "a/b/c.txt", req.PathValue("path"))
+
+	// Test: Dot segments can't be used to escape a route
+	rec = newRecorder()
+	handlerErr = rt.Route(rec, newRequest("GET", "/files/../users/%2e%2e/users/me"))
+	require.Nil(t, handlerErr)
+	assert.Equal(t, "me", rec.body.String())
+
+	// Test: Parameters don't match empty segments
+	handlerErr = rt.Route(newRecorder(), newRequest("GET", "/users/"))
+	require.NotNil(t, handlerErr)
+	assert.Equal(t, response.StatusCodeNotFound, handlerErr.StatusCode)
+}
+
+func TestRouterAutomaticResponses(t *testing.T) {
+	rt := New()
+	rt.Handle("GET /users/{id}", respondWith("show"))
+	rt.Handle("DELETE /users/{id}", respondWith("delete"))
+
+	// Test: Unknown path
+	handlerErr := rt.Route(newRecorder(), newRequest("GET", "/posts"))
+	require.NotNil(t, handlerErr)
+	assert.Equal(t, response.StatusCodeNotFound, handlerErr.StatusCode)
+
+	// Test: Known path, wrong method
+	rec := newRecorder()
+	handlerErr = rt.Route(rec, newRequest("PUT", "/users/1"))
+	require.Nil(t, handlerErr)
+	assert.Equal(t, response.StatusCodeMethodNotAllowed, rec.statusCode)
+	assert.Equal(t, "DELETE, GET, HEAD, OPTIONS", rec.headers.Get("allow"))
+
+	// Test: Automatic OPTIONS
+	rec = newRecorder()
+	handlerErr = rt.Route(rec, newRequest("OPTIONS", "/users/1"))
+	require.Nil(t, handlerErr)
+	assert.Equal(t, response.StatusCodeNoContent, rec.statusCode)
+	assert.Equal(t, "DELETE, GET, HEAD, OPTIONS", rec.headers.Get("allow"))
+	assert.Equal(t, 0, rec.body.Len())
+
+	// Test: "OPTIONS *" lists the methods of every route
+	rt.Handle("POST /posts", respondWith("create"))
+	rec = newRecorder()
+	handlerErr = rt.Route(rec, newRequest("OPTIONS", "*"))
+	require.Nil(t, handlerErr)
+	assert.Equal(t, response.StatusCodeNoContent, rec.statusCode)
+	assert.Equal(t, "DELETE, GET, HEAD, OPTIONS, POST", rec.headers.Get("allow"))
+	assert.Equal(t, 0, rec.body.Len())
+}
+
+func TestRouterHead(t *testing.T) {
+	rt := New()
+	rt.Handle("GET /users/{id}", respondWith("show"))
+	rt.Handle("GET /files/{path...}", respondWith("files"))
+	rt.Handle("HEAD /files/{path...}", respondWith("head files"))
+
+	// Test: HEAD runs the GET route
+	req := newRequest("HEAD", "/users/42")
+	rec := newRecorder()
+	handlerErr := rt.Route(rec, req)
+	require.Nil(t, handlerErr)
+	assert.Equal(t, "show", rec.body.String())
+	assert.Equal(t, "42", req.PathValue("id"))
+
+	// Test: A HEAD route takes priority over the GET one
+	rec = newRecorder()
+	handlerErr = rt.Route(rec, newRequest("HEAD", "/files/a.txt"))
+	require.Nil(t, handlerErr)
+	assert.Equal(t, "head files", rec.body.String())
+
+	// Test: GET doesn't run the HEAD route
+	rec = newRecorder()
+	handlerErr = rt.Route(rec, newRequest("GET", "/files/a.txt"))
+	require.Nil(t, handlerErr)
+	assert.Equal(t, "files", rec.body.String())
+}
+
+func TestRouterInvalidPatterns(t *testing.T) {
+	rt := New()
+	rt.Handle("GET /users/{id}", respondWith("show"))
+	assert.Panics(t, func() { rt.Handle("GET /users/{name}", respondWith("duplicate")) })
+	assert.Panics(t, func() { rt.Handle("users", respondWith("relative")) })
+	assert.Panics(t, func() { rt.Handle("/files/{path...}/edit", respondWith("wildcard")) })
+	assert.Panics(t, func() { rt.Handle("/users/id-{id}", respondWith("partial")) })
+	assert.NotPanics(t, func() { rt.Handle("PUT /users/{name}", respondWith("update")) })
+}
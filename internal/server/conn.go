@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// conn is the server side of a client connection. While a handler runs it keeps a read pending in the background
+// so a client that hangs up cancels the request's context, any byte it picks up is handed back to the next Read().
+type conn struct {
+	net.Conn
+	// ctx lives as long as the connection and is the parent of every request context on it
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	bgDone   chan struct{}
+	aborting bool
+	peeked   []byte
+	bgErr    error
+}
+
+const (
+	// how long and how much of the rest of a rejected request is read before the connection is closed
+	lingerTimeout = 500 * time.Millisecond
+	lingerDiscard = 256 << 10
+)
+
+func (s *Server) newConn(rawConn net.Conn) *conn {
+	ctx, cancel := context.WithCancel(s.baseCtx)
+	return &conn{Conn: rawConn, ctx: ctx, cancel: cancel}
+}
+
+func (c *conn) Read(data []byte) (int, error) {
+	c.mu.Lock()
+	if len(c.peeked) > 0 {
+		n := copy(data, c.peeked)
+		c.peeked = c.peeked[n:]
+		c.mu.Unlock()
+		return n, nil
+	}
+	if c.bgErr != nil {
+		err := c.bgErr
+		c.mu.Unlock()
+		return 0, err
+	}
+	c.mu.Unlock()
+	return c.Conn.Read(data)
+}
+
+// startBackgroundRead() watches for the client going away while the handler runs, it must only be used once the request body has been read
+func (c *conn) startBackgroundRead(onDisconnect context.CancelFunc) {
+	// the read timeout only applies to the request, the handler can take as long as it needs
+	c.Conn.SetReadDeadline(time.Time{})
+	done := make(chan struct{})
+	c.bgDone = done
+	go func() {
+		defer close(done)
+		buf := make([]byte, 1)
+		n, err := c.Conn.Read(buf)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if n > 0 {
+			c.peeked = buf[:n]
+		}
+		// the deadline set by abortPendingRead() isn't a disconnect
+		if err == nil || (c.aborting && errors.Is(err, os.ErrDeadlineExceeded)) {
+			return
+		}
+		c.bgErr = err
+		onDisconnect()
+	}()
+}
+
+// abortPendingRead() stops the background read before the connection is read from again
+func (c *conn) abortPendingRead() {
+	if c.bgDone == nil {
+		return
+	}
+	c.mu.Lock()
+	c.aborting = true
+	c.mu.Unlock()
+	// a deadline in the past wakes up the pending read
+	c.Conn.SetReadDeadline(time.Unix(1, 0))
+	<-c.bgDone
+	c.bgDone = nil
+	c.aborting = false
+}
+
+// lingeringClose() ends the connection after an error response was sent while the client may still be sending.
+// Closing a socket with unread data makes the kernel reset it, which can destroy the response before the client reads it,
+// so the write side is shut down first and whatever the client still sends is read and dropped for a short while.
+func (c *conn) lingeringClose() {
+	if closeWriter, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		closeWriter.CloseWrite()
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(lingerTimeout))
+	io.CopyN(io.Discard, c.Conn, lingerDiscard)
+	c.Conn.Close()
+}
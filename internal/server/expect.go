@@ -0,0 +1,55 @@
+package server
+
+import (
+	"io"
+	"strings"
+
+	"github.com/mbeka02/go_http/internal/request"
+	"github.com/mbeka02/go_http/internal/response"
+)
+
+// expectsContinue() reports whether the client is waiting for a 100 Continue before it sends the body.
+// ok is false for an expectation the server can't meet, which has to be answered with a 417.
+func expectsContinue(r *request.Request) (expect bool, ok bool) {
+	value, present := r.Headers.Lookup("expect")
+	// HTTP/1.0 clients don't know about interim responses so the field is ignored
+	if !present || r.RequestLine.HttpVersion == "1.0" {
+		return false, true
+	}
+	if !strings.EqualFold(strings.TrimSpace(value), "100-continue") {
+		return false, false
+	}
+	// there is nothing to wait for without a body
+	return r.Status != request.RequestStateDone, true
+}
+
+// continueReader sends the 100 Continue the first time the handler reads the body, reading it is how a handler accepts it
+type continueReader struct {
+	io.ReadCloser
+	w *responseWriter
+}
+
+func (cr *continueReader) Read(data []byte) (int, error) {
+	if err := cr.w.writeContinue(); err != nil {
+		return 0, err
+	}
+	return cr.ReadCloser.Read(data)
+}
+
+// writeContinue() sends the interim response once, it is skipped if the final response has already started
+func (w *responseWriter) writeContinue() error {
+	if w.continueSent {
+		return nil
+	}
+	w.continueSent = true
+	if w.headerSent {
+		return nil
+	}
+	if err := response.WriteStatusLine(w.conn, response.StatusCodeContinue); err != nil {
+		return err
+	}
+	if _, err := w.conn.WriteString("\r\n"); err != nil {
+		return err
+	}
+	return w.conn.Flush()
+}
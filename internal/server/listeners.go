@@ -0,0 +1,125 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// The first file descriptor passed by systemd's socket activation, the others follow it
+const listenFdsStart = 3
+
+// ListenUnix() listens on a unix domain socket at path and sets its permissions to mode, which decides who can connect.
+// The socket is created in a private directory and only moved to path once its permissions are set, so it never accepts connections it shouldn't.
+// A socket file left behind by a previous run is removed first, while one that still accepts connections or any other kind of file at path is an error.
+// The socket file is removed again when the listener is closed.
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, fmt.Errorf("unix Listen Error:%v", err)
+	}
+	// the directory is only accessible to this user and lives next to path so the rename stays on the same filesystem
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".listen-")
+	if err != nil {
+		return nil, fmt.Errorf("unix Listen Error:%v", err)
+	}
+	defer os.RemoveAll(dir)
+	tmpPath := filepath.Join(dir, "socket")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("unix Listen Error:%v", err)
+	}
+	// the file is removed under its final name by unixListener.Close()
+	listener.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmpPath, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("unix Listen Error:%v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("unix Listen Error:%v", err)
+	}
+	return &unixListener{UnixListener: listener, path: path}, nil
+}
+
+// removeStaleSocket() removes the socket file at path if nothing is listening on it anymore
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	// only a refused connection shows that the process that created the socket is gone
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// unixListener is a listener created by ListenUnix(), it reports and removes the socket under its final path
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	if err == nil {
+		os.Remove(l.path)
+	}
+	return err
+}
+
+// ListenersFromEnv() returns the listening sockets passed by a parent process through the LISTEN_PID and LISTEN_FDS variables, as done by systemd's socket activation.
+// It returns no listeners when the variables are missing or meant for another process. The variables are removed so child processes don't take the sockets too.
+func ListenersFromEnv() ([]net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if pid == "" || fds == "" {
+		return nil, nil
+	}
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	listeners := make([]net.Listener, 0, count)
+	for fd := listenFdsStart; fd < listenFdsStart+count; fd++ {
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		// FileListener() works on a copy of the descriptor so the original can be closed either way
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("error using inherited file descriptor %d:%w", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
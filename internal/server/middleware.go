@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"github.com/mbeka02/go_http/internal/request"
+	"github.com/mbeka02/go_http/internal/response"
+)
+
+// Middleware wraps a Handler to add behaviour before and/or after it runs
+type Middleware func(Handler) Handler
+
+// Chain() wraps handler with the middlewares, the first one is the outermost so it runs first and sees the response last
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// statusRecorder keeps track of what the handler has written so middlewares can inspect the response
+type statusRecorder struct {
+	ResponseWriter
+	statusCode response.StatusCode
+	written    int
+	// called once right before the response starts, middlewares use it to add headers at the last possible moment
+	beforeWrite func()
+	started     bool
+}
+
+func newStatusRecorder(w ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w, statusCode: response.StatusCodeOK}
+}
+
+func (rec *statusRecorder) start() {
+	if rec.started {
+		return
+	}
+	rec.started = true
+	if rec.beforeWrite != nil {
+		rec.beforeWrite()
+	}
+}
+
+func (rec *statusRecorder) WriteHeader(statusCode response.StatusCode) {
+	if !rec.started {
+		rec.statusCode = statusCode
+	}
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *statusRecorder) Write(data []byte) (int, error) {
+	rec.start()
+	n, err := rec.ResponseWriter.Write(data)
+	rec.written += n
+	return n, err
+}
+
+func (rec *statusRecorder) Flush() {
+	rec.start()
+	rec.ResponseWriter.Flush()
+}
+
+// Logging logs the method, target, status, body size and duration of every request
+func Logging(next Handler) Handler {
+	return func(w ResponseWriter, req *request.Request) *HandlerError {
+		start := time.Now()
+		rec := newStatusRecorder(w)
+		handlerError := next(rec, req)
+		statusCode, written := rec.statusCode, rec.written
+		if handlerError != nil {
+			statusCode, written = handlerError.StatusCode, len(handlerError.Message)
+		}
+		log.Printf("%s %s %d %d bytes in %v", req.RequestLine.Method, req.RequestLine.RequestTarget, statusCode, written, time.Since(start))
+		return handlerError
+	}
+}
+
+// Recover turns a panic in the wrapped handler into a 500 response and logs the stack trace.
+// If the response has already started the server closes the connection instead.
+func Recover(next Handler) Handler {
+	return func(w ResponseWriter, req *request.Request) (handlerError *HandlerError) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				log.Printf("panic serving %s %s: %v\n%s", req.RequestLine.Method, req.RequestLine.RequestTarget, recovered, debug.Stack())
+				handlerError = &HandlerError{
+					Message:    "Internal Server Error\n",
+					StatusCode: response.StatusCodeInternalServerError,
+				}
+			}
+		}()
+		return next(w, req)
+	}
+}
+
+type contextKey int
+
+const requestIDKey contextKey = iota
+
+// RequestID makes sure every request has an X-Request-ID, a client supplied one is kept otherwise a random one is generated.
+// The ID is echoed back in the response headers and stored in the request's context, see RequestIDFromContext().
+func RequestID(next Handler) Handler {
+	return func(w ResponseWriter, req *request.Request) *HandlerError {
+		id, ok := req.Headers.Lookup("x-request-id")
+		if !ok || id == "" {
+			id = newRequestID()
+			req.Headers.Set("X-Request-ID", id)
+		}
+		w.Header().Set("X-Request-ID", id)
+		return next(w, req.WithContext(context.WithValue(req.Context(), requestIDKey, id)))
+	}
+}
+
+// RequestIDFromContext() returns the ID stored by the RequestID middleware or an empty string if there is none
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+func newRequestID() string {
+	buf := make([]byte, 16)
+	// crypto/rand.Read never returns an error on supported platforms
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Timing reports how long the handler took to produce the response headers in a Server-Timing header
+func Timing(next Handler) Handler {
+	return func(w ResponseWriter, req *request.Request) *HandlerError {
+		start := time.Now()
+		rec := newStatusRecorder(w)
+		rec.beforeWrite = func() {
+			elapsed := float64(time.Since(start).Microseconds()) / 1000
+			w.Header().Set("Server-Timing", fmt.Sprintf("app;dur=%.3f", elapsed))
+		}
+		handlerError := next(rec, req)
+		// handlers that never write still get the header since it is sent after they return
+		rec.start()
+		return handlerError
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mbeka02/go_http/internal/headers"
+	"github.com/mbeka02/go_http/internal/request"
+	"github.com/mbeka02/go_http/internal/response"
+)
+
+func newTestRequest(method, target string) *request.Request {
+	return &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: target, HttpVersion: "1.1"},
+		Headers:     headers.NewHeaders(),
+	}
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	tag := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w ResponseWriter, req *request.Request) *HandlerError {
+				order = append(order, name)
+				return next(w, req)
+			}
+		}
+	}
+	handler := Chain(func(w ResponseWriter, req *request.Request) *HandlerError {
+		order = append(order, "handler")
+		return nil
+	}, tag("first"), tag("second"))
+
+	handlerError := handler(newResponseWriter(new(bytes.Buffer), true), newTestRequest("GET", "/"))
+	require.Nil(t, handlerError)
+	assert.Equal(t, []string{"first", "second", "handler"}, order)
+}
+
+func TestRecover(t *testing.T) {
+	// Test: A panic becomes a 500
+	handler := Recover(func(w ResponseWriter, req *request.Request) *HandlerError {
+		panic("boom")
+	})
+	handlerError := handler(newResponseWriter(new(bytes.Buffer), true), newTestRequest("GET", "/"))
+	require.NotNil(t, handlerError)
+	assert.Equal(t, response.StatusCodeInternalServerError, handlerError.StatusCode)
+}
+
+func TestRequestIDAndTiming(t *testing.T) {
+	conn := new(bytes.Buffer)
+	w := newResponseWriter(conn, true)
+	req := newTestRequest("GET", "/")
+	var fromContext string
+	handler := Chain(func(w ResponseWriter, req *request.Request) *HandlerError {
+		fromContext = RequestIDFromContext(req.Context())
+		w.Write([]byte("ok"))
+		return nil
+	}, RequestID, Timing)
+
+	handlerError := handler(w, req)
+	require.Nil(t, handlerError)
+	require.NoError(t, w.finish())
+
+	id := req.Headers.Get("x-request-id")
+	assert.Len(t, id, 32)
+	assert.Equal(t, id, w.Header().Get("x-request-id"))
+	assert.Equal(t, id, fromContext)
+	assert.Contains(t, conn.String(), "Server-Timing:app;dur=")
+
+	// Test: A client supplied request ID is kept
+	req = newTestRequest("GET", "/")
+	req.Headers.Set("X-Request-ID", "abc123")
+	w = newResponseWriter(new(bytes.Buffer), true)
+	handlerError = handler(w, req)
+	require.Nil(t, handlerError)
+	assert.Equal(t, "abc123", w.Header().Get("x-request-id"))
+	assert.Equal(t, "abc123", fromContext)
+}
@@ -0,0 +1,338 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mbeka02/go_http/internal/headers"
+	"github.com/mbeka02/go_http/internal/response"
+)
+
+// How much of the body is buffered before the response switches to chunked transfer-encoding.
+// Bodies smaller than this are sent with a computed Content-Length.
+const chunkingThreshold = 4096
+
+var (
+	ERROR_BODY_EXCEEDS_CONTENT_LENGTH = fmt.Errorf("the response body is longer than the declared Content-Length")
+	ERROR_BODY_NOT_ALLOWED            = fmt.Errorf("the response status code does not allow a body")
+	ERROR_INVALID_FINAL_STATUS        = fmt.Errorf("the status code of a final response must be between 200 and 999")
+)
+
+// ResponseWriter is what a Handler uses to build its response. The server derives the status line and default headers from whatever the handler set.
+type ResponseWriter interface {
+	// Header() returns the headers that will be sent with the response, changes made after the first Flush() or after the response has started streaming are ignored.
+	// Trailers are declared by listing their names in the "Trailer" header before the body is written and setting their values here once the body is done, this forces a chunked response.
+	Header() *headers.Headers
+	// WriteHeader() sets the status code of the response, only the first call has an effect
+	WriteHeader(statusCode response.StatusCode)
+	// Write() appends data to the response body, the status code defaults to 200 OK if WriteHeader() hasn't been called.
+	// If the handler set a Content-Length the data is streamed straight to the connection, otherwise it is buffered and sent chunked once the buffer fills up
+	Write(data []byte) (int, error)
+	// Flush() sends the status line, headers and any buffered body to the client immediately, using chunked transfer-encoding if no Content-Length was set
+	Flush()
+}
+
+type responseWriter struct {
+	conn        *bufio.Writer
+	headers     *headers.Headers
+	statusCode  response.StatusCode
+	wroteHeader bool
+	// set once the status line and headers have been written to conn
+	headerSent bool
+	chunked    bool
+	// set when the length isn't known up front and the client can't take a chunked body, the end of the body is marked by closing the connection
+	closeDelimited bool
+	// set for HEAD requests: the headers describe the body a GET would get, which is measured but never sent
+	head       bool
+	headLength int
+	// set when nothing follows the headers, because of the request method or the status code
+	noBody bool
+	// set once the client has been told to send a body it was holding back with "Expect: 100-continue"
+	continueSent  bool
+	contentLength int
+	written       int
+	// holds the body until the headers are sent
+	body      bytes.Buffer
+	keepAlive bool
+	// the HTTP version of the request, HTTP/1.0 clients get an HTTP/1.0 response without chunked encoding
+	version string
+	// the server's closed flag, a response started during shutdown asks the client to close the connection
+	serverClosed *atomic.Bool
+	err          error
+}
+
+func newResponseWriter(conn io.Writer, keepAlive bool) *responseWriter {
+	return &responseWriter{
+		conn:       bufio.NewWriter(conn),
+		headers:    headers.NewHeaders(),
+		statusCode: response.StatusCodeOK,
+		keepAlive:  keepAlive,
+		version:    "1.1",
+	}
+}
+
+func (w *responseWriter) Header() *headers.Headers {
+	return w.headers
+}
+
+func (w *responseWriter) WriteHeader(statusCode response.StatusCode) {
+	if w.wroteHeader {
+		log.Println("superfluous call to WriteHeader(), the status code has already been set")
+		return
+	}
+	w.statusCode = statusCode
+	w.wroteHeader = true
+}
+
+func (w *responseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(response.StatusCodeOK)
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if !bodyAllowed(w.statusCode) {
+		return 0, ERROR_BODY_NOT_ALLOWED
+	}
+	if w.head {
+		w.headLength += len(data)
+		return len(data), nil
+	}
+	if !w.headerSent {
+		if declaredLength, ok := w.declaredLength(); ok {
+			w.err = w.sendHeader(declaredLength)
+		} else if w.body.Len()+len(data) <= chunkingThreshold {
+			return w.body.Write(data)
+		} else {
+			w.err = w.sendHeader(-1)
+		}
+		if w.err != nil {
+			return 0, w.err
+		}
+	}
+	return w.writeBody(data)
+}
+
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(response.StatusCodeOK)
+	}
+	if w.err != nil {
+		return
+	}
+	if !w.headerSent {
+		declaredLength, ok := w.declaredLength()
+		if !ok {
+			declaredLength = -1
+		}
+		if w.err = w.sendHeader(declaredLength); w.err != nil {
+			return
+		}
+	}
+	w.err = w.conn.Flush()
+}
+
+// declaredLength() returns the Content-Length set by the handler, if any
+func (w *responseWriter) declaredLength() (int, bool) {
+	value, ok := w.headers.Lookup("content-length")
+	if !ok {
+		return 0, false
+	}
+	length, err := strconv.Atoi(value)
+	if err != nil || length < 0 {
+		log.Printf("ignoring invalid Content-Length set by the handler: %q", value)
+		w.headers.Del("content-length")
+		return 0, false
+	}
+	return length, true
+}
+
+// declaredTrailers() returns the lowercased field names listed in the handler's Trailer header
+func (w *responseWriter) declaredTrailers() []string {
+	value, ok := w.headers.Lookup("trailer")
+	if !ok {
+		return nil
+	}
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// sendHeader() writes the status line and headers followed by anything that has been buffered so far.
+// A negative bodyLength means the length is unknown and the body is sent chunked.
+func (w *responseWriter) sendHeader(bodyLength int) error {
+	// the status code and the handler's fields are checked before anything is written so the response can still be replaced by a 500
+	if !validFinalStatus(w.statusCode) {
+		return fmt.Errorf("%w: %d", ERROR_INVALID_FINAL_STATUS, w.statusCode)
+	}
+	if err := response.ValidateHeaders(w.headers); err != nil {
+		return fmt.Errorf("invalid header set by the handler:%w", err)
+	}
+	w.headerSent = true
+	headers := response.GetDefaultHeaders(bodyLength)
+	trailers := w.declaredTrailers()
+	// the handler's headers take precedence over the defaults, trailer fields are held back until the body is done
+	for key := range w.headers.All() {
+		headers.Del(key)
+	}
+	for key, value := range w.headers.All() {
+		if slices.Contains(trailers, strings.ToLower(key)) {
+			continue
+		}
+		headers.Add(key, value)
+	}
+	if !bodyAllowed(w.statusCode) {
+		// the message ends with the headers, a 304 can still describe the length of the representation it refers to
+		w.noBody = true
+		headers.Del("content-length")
+		headers.Del("trailer")
+		if declaredLength, ok := w.declaredLength(); ok && w.statusCode == response.StatusCodeNotModified {
+			headers.Set("Content-Length", strconv.Itoa(declaredLength))
+		}
+		if _, ok := w.headers.Lookup("content-type"); !ok {
+			headers.Del("content-type")
+		}
+	} else if bodyLength < 0 && w.version == "1.0" {
+		// HTTP/1.0 has no chunked encoding so the connection is closed to end the body
+		w.closeDelimited = true
+		w.keepAlive = false
+		headers.Del("content-length")
+		if len(trailers) > 0 {
+			log.Println("dropping the declared trailers since HTTP/1.0 has no chunked encoding")
+			headers.Del("trailer")
+		}
+	} else if bodyLength < 0 {
+		w.chunked = true
+		headers.Del("content-length")
+		headers.Set("Transfer-Encoding", "chunked")
+	} else {
+		w.contentLength = bodyLength
+		headers.Set("Content-Length", strconv.Itoa(bodyLength))
+		// trailers can only be carried by a chunked body
+		if len(trailers) > 0 {
+			log.Println("dropping the declared trailers since the response has a Content-Length")
+			headers.Del("trailer")
+		}
+	}
+	// a HEAD response gets the same headers as the GET one would
+	if w.head {
+		w.noBody = true
+	}
+	// the handler can ask for the connection to be closed after this response
+	if connection, _ := headers.Lookup("connection"); strings.EqualFold(connection, "close") {
+		w.keepAlive = false
+	}
+	if w.serverClosed != nil && w.serverClosed.Load() {
+		w.keepAlive = false
+	}
+	if !w.keepAlive {
+		headers.Set("Connection", "close")
+	} else if w.version == "1.0" {
+		headers.Set("Connection", "keep-alive")
+	}
+	// write the status line
+	if err := response.WriteStatusLineWithVersion(w.conn, w.version, w.statusCode, response.StatusText(w.statusCode)); err != nil {
+		return fmt.Errorf("error writing status line:%w", err)
+	}
+	// write the headers
+	if err := response.WriteHeaders(w.conn, headers); err != nil {
+		return fmt.Errorf("error writing headers:%w", err)
+	}
+	if w.body.Len() > 0 {
+		_, err := w.writeBody(w.body.Bytes())
+		w.body.Reset()
+		return err
+	}
+	return nil
+}
+
+// writeBody() writes data to the connection once the headers have been sent, framing it as a chunk if necessary
+func (w *responseWriter) writeBody(data []byte) (int, error) {
+	if w.chunked {
+		if _, err := response.WriteChunkedBody(w.conn, data); err != nil {
+			w.err = err
+			return 0, err
+		}
+		w.written += len(data)
+		return len(data), nil
+	}
+	if !w.closeDelimited && w.written+len(data) > w.contentLength {
+		w.err = ERROR_BODY_EXCEEDS_CONTENT_LENGTH
+		return 0, w.err
+	}
+	n, err := w.conn.Write(data)
+	w.written += n
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// finish() completes the response once the handler has returned: it sends the headers if that hasn't happened yet, terminates a chunked body and flushes everything to the connection
+func (w *responseWriter) finish() error {
+	if w.err != nil {
+		return w.err
+	}
+	if !w.headerSent {
+		bodyLength, ok := w.declaredLength()
+		if !ok {
+			bodyLength = w.body.Len()
+			if w.head {
+				bodyLength = w.headLength
+			}
+			// declaring trailers opts into a chunked response even for small bodies
+			if len(w.declaredTrailers()) > 0 && w.version != "1.0" {
+				bodyLength = -1
+			}
+		}
+		if err := w.sendHeader(bodyLength); err != nil {
+			return err
+		}
+	}
+	if w.noBody {
+		return w.conn.Flush()
+	}
+	if w.chunked {
+		if _, err := response.WriteChunkedBodyDone(w.conn); err != nil {
+			return err
+		}
+		trailers := headers.NewHeaders()
+		declared := w.declaredTrailers()
+		for key, value := range w.headers.All() {
+			if slices.Contains(declared, strings.ToLower(key)) {
+				trailers.Add(key, value)
+			}
+		}
+		if err := response.WriteTrailers(w.conn, trailers); err != nil {
+			return err
+		}
+	} else if !w.closeDelimited && w.written != w.contentLength {
+		// the client is still waiting for the rest of the body so the connection can't be reused
+		w.keepAlive = false
+		w.conn.Flush()
+		return fmt.Errorf("the response body (%d bytes) is shorter than the declared Content-Length (%d)", w.written, w.contentLength)
+	}
+	return w.conn.Flush()
+}
+
+// validFinalStatus() reports whether statusCode can end a response, 1xx responses are interim and the server sends those itself
+func validFinalStatus(statusCode response.StatusCode) bool {
+	return statusCode >= 200 && statusCode <= 999
+}
+
+// bodyAllowed() reports whether a response with statusCode can have a body, 1xx, 204 and 304 responses never do
+func bodyAllowed(statusCode response.StatusCode) bool {
+	return statusCode >= 200 && statusCode != response.StatusCodeNoContent && statusCode != response.StatusCodeNotModified
+}
@@ -1,13 +1,20 @@
 package server
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/mbeka02/go_http/internal/headers"
 	"github.com/mbeka02/go_http/internal/request"
@@ -17,39 +24,97 @@ import (
 type Server struct {
 	listener net.Listener
 	handler  Handler
+	config   ServerConfig
 	closed   atomic.Bool
+	// registry of the open connections, used to drain them on shutdown
+	mu    sync.Mutex
+	conns map[net.Conn]connState
+	// baseCtx is the parent of every connection's context, it is cancelled by Close() and when Shutdown() runs out of time
+	baseCtx    context.Context
+	cancelBase context.CancelFunc
+}
+
+// ServerConfig holds the optional settings of a Server, the zero value is a valid configuration.
+// A timeout or limit left at zero uses its default while a negative one disables it.
+type ServerConfig struct {
+	// BindAddress is the host name or IP address ServeWithConfig() and ServeTLSWithConfig() listen on, such as "127.0.0.1" to only accept local connections. They listen on every interface by default.
+	BindAddress string
+	// MaxRequestLineLength is the longest request line accepted, longer ones get a 414. Defaults to 8KB.
+	MaxRequestLineLength int
+	// MaxHeaderBytes and MaxHeaderCount limit the size of the header section, larger ones get a 431. Default to 1MB and 100 fields.
+	MaxHeaderBytes int
+	MaxHeaderCount int
+	// MaxBodySize is the largest request body accepted, larger ones get a 413. Defaults to 10MB.
+	MaxBodySize int
+	// ObsFold decides what happens to header values folded across lines, they are rejected with a 400 by default
+	ObsFold headers.ObsFoldPolicy
+	// ReadHeaderTimeout limits how long the client can take to send the request line and headers, counted from the first byte. Defaults to 10 seconds.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout limits how long the client can take to send the whole request including the body, counted from the first byte. There is no limit by default.
+	ReadTimeout time.Duration
+	// WriteTimeout limits how long writing the response can take, counted from the end of the request. There is no limit by default.
+	WriteTimeout time.Duration
+	// IdleTimeout is how long a connection waits for the first byte of the next request before it is closed. Defaults to 5 seconds.
+	IdleTimeout time.Duration
+	// HandlerTimeout cancels the request's context once the handler has been running this long, the handler is expected to notice and return. There is no limit by default.
+	HandlerTimeout time.Duration
+	// CheckContinue is called before the handler for requests with "Expect: 100-continue", returning a HandlerError such as a 417 or 413 rejects the body before the client sends it.
+	// Otherwise the 100 Continue is sent when the handler first reads the body.
+	CheckContinue func(req *request.Request) *HandlerError
+	// TLSConfig serves the connections over TLS when it is set, it must provide a certificate unless the server was started with ServeTLS()
+	TLSConfig *tls.Config
+	// PanicHandler is called after a panic in the handler has been recovered, it receives the request being served, the recovered value and the stack trace
+	PanicHandler func(req *request.Request, recovered any, stack []byte)
 }
 type HandlerError struct {
 	Message    string
-	StatusCode int
+	StatusCode response.StatusCode
+	// Reason overrides the standard reason phrase for StatusCode when it isn't empty
+	Reason string
 }
 
-type Handler func(w io.Writer, req *request.Request) *HandlerError
+type Handler func(w ResponseWriter, req *request.Request) *HandlerError
 
-func respondWithError(w io.Writer, message string, statusCode int) error {
-	var statusLine string
-	switch statusCode {
-	case 400:
-		statusLine = "HTTP/1.1 400 Bad Request\r\n"
-	case 500:
-		statusLine = "HTTP/1.1 500 Internal Server Error\r\n"
-	default:
-		statusLine = fmt.Sprintf("HTTP/1.1 %d Unknown Error\r\n", statusCode)
-	}
+const (
+	// The maximum number of requests served on a single connection before it is closed
+	maxRequestsPerConn = 100
+	// How much of an unread request body is discarded to keep the connection alive
+	maxBodyDiscard = 256 << 10
+)
 
+// respondWithError() writes a complete plain text response, it is used for parse errors and HandlerErrors.
+// r is the request being answered, it is nil for errors found before the request could be parsed which are answered as HTTP/1.1.
+func respondWithError(w io.Writer, r *request.Request, message string, statusCode response.StatusCode, reason string, keepAlive bool) error {
+	if reason == "" {
+		reason = response.StatusText(statusCode)
+	}
+	version := "1.1"
+	if r != nil {
+		version = r.RequestLine.HttpVersion
+	}
 	body := []byte(message)
-	contentLength := len(body)
-	headers := fmt.Sprintf(
-		"Content-Length: %d\r\nConnection: close\r\nContent-Type: text/plain\r\n\r\n",
-		contentLength,
-	)
-
-	if _, err := w.Write([]byte(statusLine)); err != nil {
+	headers := response.GetDefaultHeaders(len(body))
+	if !bodyAllowed(statusCode) {
+		// the message ends with the headers, a client would read anything after them as the next response
+		body = nil
+		headers.Del("content-length")
+		headers.Del("content-type")
+	}
+	if !keepAlive {
+		headers.Set("Connection", "close")
+	} else if version == "1.0" {
+		headers.Set("Connection", "keep-alive")
+	}
+	if err := response.WriteStatusLineWithVersion(w, version, statusCode, reason); err != nil {
 		return err
 	}
-	if _, err := w.Write([]byte(headers)); err != nil {
+	if err := response.WriteHeaders(w, headers); err != nil {
 		return err
 	}
+	// a HEAD request only gets the headers
+	if r != nil && r.RequestLine.Method == "HEAD" {
+		return nil
+	}
 	if _, err := w.Write(body); err != nil {
 		return err
 	}
@@ -57,22 +122,80 @@ func respondWithError(w io.Writer, message string, statusCode int) error {
 	return nil
 }
 
+// checkHandlerError() replaces a HandlerError whose status code can't end a response with a 500
+func checkHandlerError(r *request.Request, handlerError *HandlerError) *HandlerError {
+	if handlerError == nil || validFinalStatus(handlerError.StatusCode) {
+		return handlerError
+	}
+	log.Printf("invalid status code %d in the error for %s %s", handlerError.StatusCode, r.RequestLine.Method, r.RequestLine.RequestTarget)
+	return &HandlerError{Message: "Internal Server Error\n", StatusCode: response.StatusCodeInternalServerError}
+}
+
+// wantsKeepAlive() reports whether the client allows the connection to be reused. HTTP/1.1 connections are persistent unless the client sends "Connection: close",
+// HTTP/1.0 ones are closed unless the client sends "Connection: keep-alive".
+func wantsKeepAlive(r *request.Request) bool {
+	http10 := r.RequestLine.HttpVersion == "1.0"
+	connection, ok := r.Headers.Lookup("connection")
+	if !ok {
+		return !http10
+	}
+	keepAlive := !http10
+	for _, option := range strings.Split(connection, ",") {
+		option = strings.TrimSpace(option)
+		if strings.EqualFold(option, "close") {
+			return false
+		}
+		if strings.EqualFold(option, "keep-alive") {
+			keepAlive = true
+		}
+	}
+	return keepAlive
+}
+
 // Creates a net.Listener and returns a new Server instance. Starts listening for requests inside a goroutine.
 func Serve(port int, handler Handler) (*Server, error) {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%v", port))
+	return ServeWithConfig(port, handler, ServerConfig{})
+}
+
+// Same as Serve() but with custom settings
+func ServeWithConfig(port int, handler Handler, config ServerConfig) (*Server, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(config.BindAddress, strconv.Itoa(port)))
 	if err != nil {
 		return nil, fmt.Errorf("TCP Listen Error:%v", err)
 	}
+	return ServeListenerWithConfig(listener, handler, config), nil
+}
+
+// Serves requests from connections accepted on an existing listener, such as a unix socket from ListenUnix() or one inherited through ListenersFromEnv().
+// The server takes ownership of the listener and closes it when it is closed or shut down.
+func ServeListener(listener net.Listener, handler Handler) *Server {
+	return ServeListenerWithConfig(listener, handler, ServerConfig{})
+}
 
-	server := &Server{listener: listener, handler: handler}
+// Same as ServeListener() but with custom settings, BindAddress is ignored since the listener is already bound
+func ServeListenerWithConfig(listener net.Listener, handler Handler, config ServerConfig) *Server {
+	server := newServer(listener, handler, config.withDefaults())
 	go server.listen()
-	return server, nil
+	return server
 }
 
-// Closes the listener and the server
+func newServer(listener net.Listener, handler Handler, config ServerConfig) *Server {
+	if config.TLSConfig != nil {
+		listener = tls.NewListener(listener, config.TLSConfig)
+	}
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	return &Server{listener: listener, handler: handler, config: config, baseCtx: baseCtx, cancelBase: cancelBase}
+}
+
+// Closes the listener and every open connection immediately, use Shutdown() to let in-flight requests finish
 func (s *Server) Close() error {
+	s.mu.Lock()
 	s.closed.Store(true)
-	return s.listener.Close()
+	s.mu.Unlock()
+	s.cancelBase()
+	err := s.listener.Close()
+	s.closeAllConns()
+	return err
 }
 
 // Uses a loop to accept new connections as they come in, and handles each one in a new goroutine. I used an atomic.Bool to track whether the server is closed or not so that I can ignore connection errors after the server is closed.
@@ -95,42 +218,170 @@ func (s *Server) listen() {
 	}
 }
 
-// Handles a single connection by writing the following response and then closing the connection
-func (s *Server) handle(conn net.Conn) {
+// Handles a single connection, serving requests on it until either side wants it closed, it sits idle for too long or it reaches maxRequestsPerConn
+func (s *Server) handle(rawConn net.Conn) {
+	conn := s.newConn(rawConn)
+	defer func() {
+		// a panic outside of the handler only takes down this connection
+		if recovered := recover(); recovered != nil {
+			log.Printf("panic handling connection from %s: %v\n%s", conn.RemoteAddr(), recovered, debug.Stack())
+		}
+		log.Println("...closing the connection")
+		conn.cancel()
+		s.forgetConn(rawConn)
+		conn.Close()
+	}()
 	log.Printf("Handling connection from %s", conn.RemoteAddr())
-	// parse the request from the connection
-	r, err := request.RequestFromReader(conn)
-	if err != nil {
-		log.Printf("error parsing the request:%v", err)
-		respondWithError(conn, "Bad Request", 400)
-		return
-	}
-	buff := new(bytes.Buffer)
-	handlerError := s.handler(buff, r)
-	if handlerError != nil {
-		respondWithError(conn, handlerError.Message, handlerError.StatusCode)
-		return
-	}
-	defaultHeaders := response.GetDefaultHeaders(buff.Len()) // pass the length of the response body
-	headers := headers.NewHeaders()
-	// write the status line
-	err = response.WriteStatusLine(conn, response.StatusCodeOK)
-	if err != nil {
-		log.Printf("error writing status line:%v", err)
+	reader := newRequestReader(conn, s.config)
+	// requests are read from the connection through a single Reader so pipelined ones that arrive early aren't lost,
+	// they are served one at a time which keeps the responses in the order of the requests
+	requests := request.NewReader(reader, request.Config{
+		MaxRequestLineLength: s.config.MaxRequestLineLength,
+		MaxHeaderBytes:       s.config.MaxHeaderBytes,
+		MaxHeaderCount:       s.config.MaxHeaderCount,
+		MaxBodySize:          s.config.MaxBodySize,
+		ObsFold:              s.config.ObsFold,
+		OnHeadersDone:        reader.headersDone,
+	})
+	for served := 1; ; served++ {
+		if !s.setConnState(rawConn, connStateIdle) {
+			return
+		}
+		reader.next(requests.Buffered() > 0)
+		// parse the request from the connection
+		r, err := requests.ReadRequest()
+		if err != nil {
+			// the client closed the connection, went quiet between requests or the server closed it during shutdown
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				// a client that started a request and then stalled gets told why, an idle one is just dropped
+				if reader.started {
+					log.Printf("timed out reading the request from %s", conn.RemoteAddr())
+					respondWithError(conn, nil, "Request Timeout\n", response.StatusCodeRequestTimeout, "", false)
+				}
+				return
+			}
+			var parseErr *request.ParseError
+			if !errors.As(err, &parseErr) {
+				// the connection failed, there is nobody left to answer
+				log.Printf("error reading the request from %s:%v", conn.RemoteAddr(), err)
+				return
+			}
+			log.Printf("error parsing the request from %s:%v", conn.RemoteAddr(), parseErr)
+			statusCode := response.StatusCode(parseErr.StatusCode)
+			if respondWithError(conn, nil, response.StatusText(statusCode)+"\n", statusCode, "", false) == nil {
+				conn.lingeringClose()
+			}
+			return
+		}
+		// the handshake is done by the time a request has been read from a TLS connection
+		if tlsConn, ok := rawConn.(*tls.Conn); ok {
+			state := tlsConn.ConnectionState()
+			r.TLS = &state
+		}
+		// the read deadline is left in place since the handler streams the body from the connection
+		s.setConnState(rawConn, connStateActive)
+		conn.SetWriteDeadline(deadlineAfter(time.Now(), s.config.WriteTimeout))
+		keepAlive := wantsKeepAlive(r) && served < maxRequestsPerConn && !s.closed.Load()
+		keepAlive, err = s.respond(conn, r, keepAlive)
+		if err != nil {
+			log.Printf("error writing the response:%v", err)
+			return
+		}
+		if !keepAlive {
+			return
+		}
 	}
-	// add the default headers to the headers map
-	for key, value := range defaultHeaders {
-		headers[key] = value
+}
+
+// Runs the handler for a single request and writes its response to the connection. It reports whether the connection can still be reused afterwards.
+func (s *Server) respond(conn *conn, r *request.Request, keepAlive bool) (reuse bool, err error) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if s.config.HandlerTimeout > 0 {
+		ctx, cancel = context.WithTimeout(conn.ctx, s.config.HandlerTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(conn.ctx)
 	}
-	// write the headers
-	err = response.WriteHeaders(conn, headers)
-	if err != nil {
-		log.Printf("error writing headers:%v", err)
+	defer cancel()
+	r = r.WithContext(ctx)
+	// with the whole request read a client that hangs up can be noticed while the handler runs, otherwise the handler would see it while reading the body
+	if r.Status == request.RequestStateDone {
+		conn.startBackgroundRead(cancel)
 	}
-	// write the  response body from the handlers buffer
-	conn.Write(buff.Bytes())
+	defer conn.abortPendingRead()
+	w := newResponseWriter(conn, keepAlive)
+	w.version = r.RequestLine.HttpVersion
+	w.head = r.RequestLine.Method == "HEAD"
+	w.serverClosed = &s.closed
 	defer func() {
-		log.Println("...closing the connection")
-		conn.Close()
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+		stack := debug.Stack()
+		log.Printf("panic serving %s %s: %v\n%s", r.RequestLine.Method, r.RequestLine.RequestTarget, recovered, stack)
+		if s.config.PanicHandler != nil {
+			s.config.PanicHandler(r, recovered, stack)
+		}
+		// the handler was interrupted so the connection isn't reused either way
+		reuse = false
+		if w.headerSent {
+			err = fmt.Errorf("aborting the connection, the handler panicked after the response was started: %v", recovered)
+			return
+		}
+		err = respondWithError(conn, r, "Internal Server Error\n", response.StatusCodeInternalServerError, "", false)
 	}()
+	expectContinue, ok := expectsContinue(r)
+	if !ok {
+		return false, respondWithError(conn, r, "Expectation Failed\n", response.StatusCodeExpectationFailed, "", false)
+	}
+	if expectContinue {
+		if s.config.CheckContinue != nil {
+			if handlerError := checkHandlerError(r, s.config.CheckContinue(r)); handlerError != nil {
+				return false, respondWithError(conn, r, handlerError.Message, handlerError.StatusCode, handlerError.Reason, false)
+			}
+		}
+		r.Body = &continueReader{ReadCloser: r.Body, w: w}
+	}
+	handlerError := checkHandlerError(r, s.handler(w, r))
+	// the next request starts where this body ends so whatever the handler didn't read is skipped, a body too large to skip costs the connection.
+	// A client still holding the body back for a 100 Continue can only be skipped by closing the connection.
+	var discardErr error
+	if expectContinue && !w.continueSent {
+		keepAlive = false
+		w.keepAlive = false
+	} else if discardErr = r.DiscardBody(maxBodyDiscard); discardErr != nil {
+		keepAlive = false
+		w.keepAlive = false
+	}
+	// a body the parser refused, such as one over MaxBodySize, gets the parse error's status whatever the handler made of it
+	var parseErr *request.ParseError
+	if errors.As(discardErr, &parseErr) && !w.headerSent {
+		log.Printf("error parsing the body of %s %s:%v", r.RequestLine.Method, r.RequestLine.RequestTarget, parseErr)
+		statusCode := response.StatusCode(parseErr.StatusCode)
+		return false, respondWithError(conn, r, response.StatusText(statusCode)+"\n", statusCode, "", false)
+	}
+	if handlerError != nil {
+		// part of the response is already on the wire so the error can't be reported to the client
+		if w.headerSent {
+			return false, fmt.Errorf("handler error after the response was started: %s", handlerError.Message)
+		}
+		keepAlive = keepAlive && !s.closed.Load()
+		return keepAlive, respondWithError(conn, r, handlerError.Message, handlerError.StatusCode, handlerError.Reason, keepAlive)
+	}
+	if err := w.finish(); err != nil {
+		// nothing reached the client when the handler's headers were refused so it can still be told
+		if !w.headerSent {
+			log.Printf("error in the response to %s %s:%v", r.RequestLine.Method, r.RequestLine.RequestTarget, err)
+			keepAlive = w.keepAlive && !s.closed.Load()
+			return keepAlive, respondWithError(conn, r, "Internal Server Error\n", response.StatusCodeInternalServerError, "", keepAlive)
+		}
+		return false, err
+	}
+	return w.keepAlive, nil
 }
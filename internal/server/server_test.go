@@ -0,0 +1,1137 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mbeka02/go_http/internal/request"
+	"github.com/mbeka02/go_http/internal/response"
+)
+
+// respondOverPipe runs s.respond() for req and returns what the client received
+func respondOverPipe(t *testing.T, s *Server, req *request.Request) (string, bool, error) {
+	t.Helper()
+	client, conn := net.Pipe()
+	var (
+		reuse bool
+		err   error
+	)
+	go func() {
+		reuse, err = s.respond(s.newConn(conn), req, true)
+		conn.Close()
+	}()
+	data, readErr := io.ReadAll(client)
+	require.NoError(t, readErr)
+	return string(data), reuse, err
+}
+
+func TestRespondRecoversPanics(t *testing.T) {
+	var reported any
+	s := newServer(nil, nil, ServerConfig{
+		PanicHandler: func(req *request.Request, recovered any, stack []byte) {
+			reported = recovered
+		},
+	})
+
+	// Test: Panic before anything was written
+	s.handler = func(w ResponseWriter, req *request.Request) *HandlerError {
+		w.Write([]byte("buffered, never sent"))
+		panic("boom")
+	}
+	data, reuse, err := respondOverPipe(t, s, newTestRequest("GET", "/"))
+	require.NoError(t, err)
+	assert.False(t, reuse)
+	assert.Contains(t, data, "HTTP/1.1 500 Internal Server Error\r\n")
+	assert.Contains(t, data, "Connection:close\r\n")
+	assert.NotContains(t, data, "buffered")
+	assert.Equal(t, "boom", reported)
+
+	// Test: Panic after the response started
+	s.handler = func(w ResponseWriter, req *request.Request) *HandlerError {
+		w.Write([]byte("partial"))
+		w.Flush()
+		panic("late boom")
+	}
+	data, reuse, err = respondOverPipe(t, s, newTestRequest("GET", "/"))
+	require.Error(t, err)
+	assert.False(t, reuse)
+	assert.Contains(t, data, "HTTP/1.1 200 OK\r\n")
+	assert.NotContains(t, data, "500")
+	assert.Equal(t, "late boom", reported)
+}
+
+// startTestServer serves handler on a random local port
+func startTestServer(t *testing.T, handler Handler) *Server {
+	return startTestServerWithConfig(t, handler, ServerConfig{})
+}
+
+func startTestServerWithConfig(t *testing.T, handler Handler, config ServerConfig) *Server {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := newServer(listener, handler, config)
+	go s.listen()
+	return s
+}
+
+func TestKeepAlive(t *testing.T) {
+	s := startTestServerWithConfig(t, func(w ResponseWriter, req *request.Request) *HandlerError {
+		w.Write([]byte("ok"))
+		return nil
+	}, ServerConfig{IdleTimeout: 200 * time.Millisecond})
+	defer s.Close()
+	addr := s.listener.Addr().String()
+	// readResponse reads one response and returns its header section
+	readResponse := func(reader *bufio.Reader) string {
+		var head strings.Builder
+		for {
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			if line == "\r\n" {
+				break
+			}
+			head.WriteString(line)
+		}
+		body := make([]byte, 2)
+		_, err := io.ReadFull(reader, body)
+		require.NoError(t, err)
+		assert.Equal(t, "ok", string(body))
+		return head.String()
+	}
+
+	// Test: Requests are served one after another on the same connection until the cap is reached
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for i := 1; i <= maxRequestsPerConn; i++ {
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n"))
+		require.NoError(t, err)
+		head := readResponse(reader)
+		if i < maxRequestsPerConn {
+			require.NotContains(t, head, "Connection:", "request %d", i)
+		} else {
+			assert.Contains(t, head, "Connection:close\r\n")
+		}
+	}
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: The client asking to close ends the connection after the response
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	reader = bufio.NewReader(conn)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Contains(t, readResponse(reader), "Connection:close\r\n")
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: A connection left idle after a response is closed once the idle timeout passes
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	reader = bufio.NewReader(conn)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n"))
+	require.NoError(t, err)
+	readResponse(reader)
+	start := time.Now()
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s := startTestServer(t, func(w ResponseWriter, req *request.Request) *HandlerError {
+		if req.RequestLine.RequestTarget == "/slow" {
+			close(started)
+			<-release
+		}
+		w.Write([]byte("done"))
+		return nil
+	})
+	addr := s.listener.Addr().String()
+
+	// an idle keep-alive connection
+	idle, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer idle.Close()
+	_, err = idle.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n"))
+	require.NoError(t, err)
+	buf := make([]byte, 1024)
+	_, err = idle.Read(buf)
+	require.NoError(t, err)
+
+	// a connection with a request in flight
+	active, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer active.Close()
+	_, err = active.Write([]byte("GET /slow HTTP/1.1\r\nHost: test\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.Shutdown(context.Background())
+	}()
+
+	// the idle connection is closed without a response
+	idle.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = idle.Read(buf)
+	assert.ErrorIs(t, err, io.EOF)
+
+	// new connections are refused
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err)
+
+	// shutdown waits for the active request
+	select {
+	case <-shutdownErr:
+		t.Fatal("Shutdown() returned before the active request finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	data, err := io.ReadAll(active)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "Connection:close\r\n")
+	assert.Contains(t, string(data), "done")
+	require.NoError(t, <-shutdownErr)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	s := startTestServer(t, func(w ResponseWriter, req *request.Request) *HandlerError {
+		close(started)
+		<-release
+		return nil
+	})
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = s.Shutdown(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	// the connection was force closed
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestTimeouts(t *testing.T) {
+	s := startTestServerWithConfig(t, func(w ResponseWriter, req *request.Request) *HandlerError {
+		// the body is streamed so a stalled upload shows up as a read error in the handler
+		if _, err := io.ReadAll(req.Body); errors.Is(err, os.ErrDeadlineExceeded) {
+			return &HandlerError{Message: "Request Timeout\n", StatusCode: response.StatusCodeRequestTimeout}
+		}
+		w.Write([]byte("done"))
+		return nil
+	}, ServerConfig{
+		IdleTimeout:       100 * time.Millisecond,
+		ReadHeaderTimeout: 200 * time.Millisecond,
+		ReadTimeout:       400 * time.Millisecond,
+	})
+	defer s.Close()
+	addr := s.listener.Addr().String()
+
+	// Test: An idle connection is closed without a response
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Empty(t, data)
+
+	// Test: A client trickling the headers gets a 408
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: te"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "HTTP/1.1 408 Request Timeout\r\n")
+
+	// Test: A body that never arrives is limited by the read timeout
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 10\r\n\r\nabc"))
+	require.NoError(t, err)
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "HTTP/1.1 408 Request Timeout\r\n")
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+}
+
+func TestWriteTimeoutIsPerResponse(t *testing.T) {
+	s := startTestServerWithConfig(t, func(w ResponseWriter, req *request.Request) *HandlerError {
+		w.Write([]byte("ok"))
+		return nil
+	}, ServerConfig{
+		IdleTimeout:  2 * time.Second,
+		WriteTimeout: 200 * time.Millisecond,
+	})
+	defer s.Close()
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(buf[:n]), "\r\n\r\nok"), string(buf[:n]))
+
+	// Test: A parse error after the previous response's write timeout has passed still gets its 400
+	time.Sleep(500 * time.Millisecond)
+	_, err = conn.Write([]byte("BAD\r\n\r\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "HTTP/1.1 400 Bad Request\r\n"), string(data))
+}
+
+func TestLimits(t *testing.T) {
+	s := startTestServerWithConfig(t, func(w ResponseWriter, req *request.Request) *HandlerError {
+		// a handler that turns any body error into a 400 doesn't hide the limit
+		if req.RequestLine.URL.Path == "/read" {
+			if _, err := io.ReadAll(req.Body); err != nil {
+				return &HandlerError{Message: err.Error(), StatusCode: response.StatusCodeBadRequest}
+			}
+		}
+		return nil
+	}, ServerConfig{MaxRequestLineLength: 64, MaxHeaderBytes: 128, MaxBodySize: 16})
+	defer s.Close()
+
+	tests := []struct {
+		request string
+		status  string
+	}{
+		{"GET /" + strings.Repeat("a", 100) + " HTTP/1.1\r\n\r\n", "HTTP/1.1 414 URI Too Long\r\n"},
+		{"GET / HTTP/1.1\r\nCookie: " + strings.Repeat("a", 200) + "\r\n\r\n", "HTTP/1.1 431 Request Header Fields Too Large\r\n"},
+		{"POST / HTTP/1.1\r\nContent-Length: 17\r\n\r\n", "HTTP/1.1 413 Content Too Large\r\n"},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n", "HTTP/1.1 501 Not Implemented\r\n"},
+		{"GET / HTTP/3.0\r\n\r\n", "HTTP/1.1 505 HTTP Version Not Supported\r\n"},
+		{"GET / HTTP/1.1\r\nHost : test\r\n\r\n", "HTTP/1.1 400 Bad Request\r\n"},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n10\r\n" + strings.Repeat("a", 16) + "\r\n1\r\na\r\n0\r\n\r\n", "HTTP/1.1 413 Content Too Large\r\n"},
+		{"POST /read HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n1\r\na\r\n7fffffffffffffff\r\n" + strings.Repeat("a", 100), "HTTP/1.1 413 Content Too Large\r\n"},
+	}
+	for _, tc := range tests {
+		conn, err := net.Dial("tcp", s.listener.Addr().String())
+		require.NoError(t, err)
+		_, err = conn.Write([]byte(tc.request))
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		data, err := io.ReadAll(conn)
+		conn.Close()
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(string(data), tc.status), string(data))
+	}
+}
+
+func TestUnreadBodyIsDiscarded(t *testing.T) {
+	s := startTestServer(t, func(w ResponseWriter, req *request.Request) *HandlerError {
+		w.Write([]byte(req.RequestLine.URL.Path))
+		return nil
+	})
+	defer s.Close()
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the handler ignores the body, the next request on the connection must still parse
+	_, err = conn.Write([]byte("POST /first HTTP/1.1\r\nHost: test\r\nContent-Length: 11\r\n\r\nhello world"))
+	require.NoError(t, err)
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	assert.Contains(t, string(buf[:n]), "/first")
+
+	_, err = conn.Write([]byte("GET /second HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, string(data), "/second")
+}
+
+func TestRequestContext(t *testing.T) {
+	cancelled := make(chan error, 1)
+	started := make(chan struct{}, 1)
+	s := startTestServerWithConfig(t, func(w ResponseWriter, req *request.Request) *HandlerError {
+		if req.RequestLine.URL.Path == "/fast" {
+			w.Write([]byte("fast"))
+			return nil
+		}
+		started <- struct{}{}
+		<-req.Context().Done()
+		cancelled <- context.Cause(req.Context())
+		return nil
+	}, ServerConfig{HandlerTimeout: 300 * time.Millisecond})
+	addr := s.listener.Addr().String()
+
+	// Test: The context is cancelled when the client hangs up
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("GET /wait HTTP/1.1\r\nHost: test\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+	start := time.Now()
+	conn.Close()
+	assert.ErrorIs(t, <-cancelled, context.Canceled)
+	assert.Less(t, time.Since(start), 250*time.Millisecond)
+
+	// Test: The context is cancelled once the handler timeout fires
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /wait HTTP/1.1\r\nHost: test\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+	assert.ErrorIs(t, <-cancelled, context.DeadlineExceeded)
+
+	// Test: A byte read while watching for a disconnect isn't lost, the next request on the connection still parses
+	_, err = conn.Write([]byte("GET /fast HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "fast")
+
+	// Test: Shutdown lets the request run and only cancels its context once it stops waiting
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /wait HTTP/1.1\r\nHost: test\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	assert.ErrorIs(t, <-cancelled, context.Canceled)
+}
+
+func TestResponseHeaders(t *testing.T) {
+	s := newServer(nil, func(w ResponseWriter, req *request.Request) *HandlerError {
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		w.Header().Set("content-type", "application/json")
+		w.Write([]byte("{}"))
+		return nil
+	}, ServerConfig{})
+	data, _, err := respondOverPipe(t, s, newTestRequest("GET", "/"))
+	require.NoError(t, err)
+	// the handler's fields override the defaults and cookies aren't combined
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length:2\r\nSet-Cookie:a=1\r\nSet-Cookie:b=2\r\ncontent-type:application/json\r\n\r\n{}", data)
+}
+
+func TestStreamingResponses(t *testing.T) {
+	large := strings.Repeat("a", chunkingThreshold+1)
+	s := newServer(nil, func(w ResponseWriter, req *request.Request) *HandlerError {
+		switch req.RequestLine.RequestTarget {
+		case "/large":
+			w.Write([]byte(large))
+		case "/buffered":
+			// the first write fits in the buffer and is sent as a chunk of its own once the second one overflows it
+			w.Write([]byte(strings.Repeat("b", chunkingThreshold-1)))
+			w.Write([]byte("cc"))
+		case "/flush":
+			w.Flush()
+			w.Write([]byte("ab"))
+			w.Flush()
+			w.Write([]byte("c"))
+		case "/too-long":
+			w.Header().Set("Content-Length", "3")
+			_, err := w.Write([]byte("abcd"))
+			assert.ErrorIs(t, err, ERROR_BODY_EXCEEDS_CONTENT_LENGTH)
+		case "/too-short":
+			w.Header().Set("Content-Length", "5")
+			w.Write([]byte("abc"))
+		}
+		return nil
+	}, ServerConfig{})
+	chunkedHeaders := "HTTP/1.1 200 OK\r\nContent-Type:text/plain\r\nTransfer-Encoding:chunked\r\n\r\n"
+
+	// Test: A body larger than the buffer switches to chunked encoding
+	data, reuse, err := respondOverPipe(t, s, newTestRequest("GET", "/large"))
+	require.NoError(t, err)
+	assert.True(t, reuse)
+	assert.Equal(t, chunkedHeaders+"1001\r\n"+large+"\r\n0\r\n\r\n", data)
+
+	// Test: The buffered part of the body becomes the first chunk
+	data, _, err = respondOverPipe(t, s, newTestRequest("GET", "/buffered"))
+	require.NoError(t, err)
+	assert.Equal(t, chunkedHeaders+"fff\r\n"+strings.Repeat("b", chunkingThreshold-1)+"\r\n2\r\ncc\r\n0\r\n\r\n", data)
+
+	// Test: Flush() before any write starts a chunked response
+	data, reuse, err = respondOverPipe(t, s, newTestRequest("GET", "/flush"))
+	require.NoError(t, err)
+	assert.True(t, reuse)
+	assert.Equal(t, chunkedHeaders+"2\r\nab\r\n1\r\nc\r\n0\r\n\r\n", data)
+
+	// Test: Writing past the declared Content-Length fails and the connection isn't reused
+	data, reuse, err = respondOverPipe(t, s, newTestRequest("GET", "/too-long"))
+	require.ErrorIs(t, err, ERROR_BODY_EXCEEDS_CONTENT_LENGTH)
+	assert.False(t, reuse)
+	// the headers were still buffered so the client sees the connection close rather than a truncated response
+	assert.Empty(t, data)
+
+	// Test: A body shorter than the declared Content-Length is sent as is and the connection isn't reused
+	data, reuse, err = respondOverPipe(t, s, newTestRequest("GET", "/too-short"))
+	require.Error(t, err)
+	assert.False(t, reuse)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type:text/plain\r\nContent-Length:5\r\n\r\nabc", data)
+}
+
+func TestResponseTrailers(t *testing.T) {
+	large := strings.Repeat("a", chunkingThreshold+1)
+	s := newServer(nil, func(w ResponseWriter, req *request.Request) *HandlerError {
+		w.Header().Set("Trailer", "X-Checksum, X-Count")
+		// a value set before the body is still held back for the trailer section
+		w.Header().Set("X-Count", "1")
+		switch req.RequestLine.RequestTarget {
+		case "/large":
+			w.Write([]byte(large))
+		case "/content-length":
+			w.Header().Set("Content-Length", "5")
+			w.Write([]byte("hello"))
+		default:
+			w.Write([]byte("hello"))
+		}
+		w.Header().Set("X-Checksum", "abc")
+		return nil
+	}, ServerConfig{})
+	chunkedHeaders := "HTTP/1.1 200 OK\r\nContent-Type:text/plain\r\nTrailer:X-Checksum, X-Count\r\nTransfer-Encoding:chunked\r\n\r\n"
+
+	// Test: Declaring trailers makes even a small body chunked, the trailer fields follow the last chunk
+	data, reuse, err := respondOverPipe(t, s, newTestRequest("GET", "/"))
+	require.NoError(t, err)
+	assert.True(t, reuse)
+	assert.Equal(t, chunkedHeaders+"5\r\nhello\r\n0\r\nX-Count:1\r\nX-Checksum:abc\r\n\r\n", data)
+
+	// Test: Trailers after a body that was already streamed
+	data, _, err = respondOverPipe(t, s, newTestRequest("GET", "/large"))
+	require.NoError(t, err)
+	assert.Equal(t, chunkedHeaders+"1001\r\n"+large+"\r\n0\r\nX-Count:1\r\nX-Checksum:abc\r\n\r\n", data)
+
+	// Test: A Content-Length leaves no room for trailers so they are dropped along with the Trailer header
+	data, reuse, err = respondOverPipe(t, s, newTestRequest("GET", "/content-length"))
+	require.NoError(t, err)
+	assert.True(t, reuse)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type:text/plain\r\nContent-Length:5\r\n\r\nhello", data)
+}
+
+func TestInvalidResponseHeaders(t *testing.T) {
+	s := newServer(nil, func(w ResponseWriter, req *request.Request) *HandlerError {
+		w.Header().Set("X-Evil", "a\r\nInjected: 1")
+		if req.RequestLine.RequestTarget == "/flush" {
+			w.Flush()
+		}
+		w.Write([]byte("hello"))
+		return nil
+	}, ServerConfig{})
+
+	// Test: The response is replaced by a 500 before anything is written
+	for _, target := range []string{"/", "/flush"} {
+		data, reuse, err := respondOverPipe(t, s, newTestRequest("GET", target))
+		require.NoError(t, err)
+		assert.True(t, reuse)
+		assert.Equal(t, "HTTP/1.1 500 Internal Server Error\r\nContent-Length:22\r\nContent-Type:text/plain\r\n\r\nInternal Server Error\n", data)
+	}
+}
+
+func TestResponseWriter(t *testing.T) {
+	s := newServer(nil, func(w ResponseWriter, req *request.Request) *HandlerError {
+		switch req.RequestLine.RequestTarget {
+		case "/created":
+			w.Header().Set("Location", "/users/1")
+			w.WriteHeader(response.StatusCodeCreated)
+			// only the first status code counts
+			w.WriteHeader(response.StatusCodeOK)
+			w.Write([]byte("created"))
+		case "/redirect":
+			w.Header().Set("Location", "/elsewhere")
+			w.WriteHeader(response.StatusCodeFound)
+		case "/teapot":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(response.StatusCodeTeapot)
+			w.Write([]byte("{}"))
+		case "/close":
+			w.Header().Set("Connection", "close")
+			w.Write([]byte("bye"))
+		case "/no-content":
+			w.WriteHeader(response.StatusCodeNoContent)
+		}
+		return nil
+	}, ServerConfig{})
+
+	// Test: Custom status code with a header of the handler's own
+	data, reuse, err := respondOverPipe(t, s, newTestRequest("POST", "/created"))
+	require.NoError(t, err)
+	assert.True(t, reuse)
+	assert.Equal(t, "HTTP/1.1 201 Created\r\nContent-Length:7\r\nContent-Type:text/plain\r\nLocation:/users/1\r\n\r\ncreated", data)
+
+	// Test: Redirect without a body
+	data, reuse, err = respondOverPipe(t, s, newTestRequest("GET", "/redirect"))
+	require.NoError(t, err)
+	assert.True(t, reuse)
+	assert.Equal(t, "HTTP/1.1 302 Found\r\nContent-Length:0\r\nContent-Type:text/plain\r\nLocation:/elsewhere\r\n\r\n", data)
+
+	// Test: The handler's Content-Type replaces the default one
+	data, _, err = respondOverPipe(t, s, newTestRequest("GET", "/teapot"))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 418 I'm a teapot\r\nContent-Length:2\r\nContent-Type:application/json\r\n\r\n{}", data)
+
+	// Test: The handler can ask for the connection to be closed
+	data, reuse, err = respondOverPipe(t, s, newTestRequest("GET", "/close"))
+	require.NoError(t, err)
+	assert.False(t, reuse)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length:3\r\nContent-Type:text/plain\r\nConnection:close\r\n\r\nbye", data)
+
+	// Test: 204 without any body headers
+	data, reuse, err = respondOverPipe(t, s, newTestRequest("DELETE", "/no-content"))
+	require.NoError(t, err)
+	assert.True(t, reuse)
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n\r\n", data)
+}
+
+func TestInvalidStatusCodes(t *testing.T) {
+	s := newServer(nil, func(w ResponseWriter, req *request.Request) *HandlerError {
+		switch req.RequestLine.RequestTarget {
+		case "/too-small":
+			w.WriteHeader(99)
+			w.Write([]byte("hello"))
+		case "/interim":
+			w.WriteHeader(response.StatusCodeSwitchingProtocols)
+		case "/error":
+			return &HandlerError{Message: "too large\n", StatusCode: 1000}
+		}
+		return nil
+	}, ServerConfig{})
+
+	// Test: Status codes that can't end a response are answered with a 500
+	for _, target := range []string{"/too-small", "/interim", "/error"} {
+		data, reuse, err := respondOverPipe(t, s, newTestRequest("GET", target))
+		require.NoError(t, err, target)
+		assert.True(t, reuse, target)
+		assert.Equal(t, "HTTP/1.1 500 Internal Server Error\r\nContent-Length:22\r\nContent-Type:text/plain\r\n\r\nInternal Server Error\n", data, target)
+	}
+}
+
+func TestHTTP10(t *testing.T) {
+	s := startTestServer(t, func(w ResponseWriter, req *request.Request) *HandlerError {
+		if req.RequestLine.URL.Path == "/large" {
+			w.Write([]byte(strings.Repeat("a", chunkingThreshold+1)))
+			return nil
+		}
+		w.Write([]byte("ok"))
+		return nil
+	})
+	defer s.Close()
+	addr := s.listener.Addr().String()
+
+	// Test: The connection is closed after the response by default
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.0 200 OK\r\nContent-Length:2\r\nContent-Type:text/plain\r\nConnection:close\r\n\r\nok", string(data))
+
+	// Test: Keep-alive when the client asks for it
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"))
+	require.NoError(t, err)
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	assert.Contains(t, string(buf[:n]), "Connection:keep-alive\r\n")
+	_, err = conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "HTTP/1.0 200 OK\r\n"), string(data))
+
+	// Test: A body of unknown length is ended by closing the connection instead of being chunked
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /large HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	head, body, _ := strings.Cut(string(data), "\r\n\r\n")
+	assert.NotContains(t, head, "Transfer-Encoding")
+	assert.NotContains(t, head, "Content-Length")
+	assert.Contains(t, head, "Connection:close")
+	assert.Equal(t, strings.Repeat("a", chunkingThreshold+1), body)
+}
+
+func TestExpectContinue(t *testing.T) {
+	var handlerCalls atomic.Int32
+	s := startTestServerWithConfig(t, func(w ResponseWriter, req *request.Request) *HandlerError {
+		handlerCalls.Add(1)
+		if req.RequestLine.URL.Path == "/reject" {
+			return &HandlerError{Message: "Content Too Large\n", StatusCode: response.StatusCodeContentTooLarge}
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return &HandlerError{Message: err.Error(), StatusCode: response.StatusCodeBadRequest}
+		}
+		w.Write(body)
+		return nil
+	}, ServerConfig{
+		MaxBodySize: 16,
+		CheckContinue: func(req *request.Request) *HandlerError {
+			if req.RequestLine.URL.Path == "/denied" {
+				return &HandlerError{Message: "Expectation Failed\n", StatusCode: response.StatusCodeExpectationFailed}
+			}
+			return nil
+		},
+	})
+	defer s.Close()
+	addr := s.listener.Addr().String()
+
+	// Test: The body is requested once the handler reads it
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("POST /echo HTTP/1.1\r\nHost: test\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	interim := make([]byte, len("HTTP/1.1 100 Continue\r\n\r\n"))
+	_, err = io.ReadFull(conn, interim)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", string(interim))
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(buf[:n]), "HTTP/1.1 200 OK\r\n"), string(buf[:n]))
+	assert.True(t, strings.HasSuffix(string(buf[:n]), "\r\n\r\nhello"), string(buf[:n]))
+	assert.NotContains(t, string(buf[:n]), "Connection:close")
+
+	tests := []struct {
+		name    string
+		request string
+		status  string
+		calls   int32
+	}{
+		{"The handler rejects the body without reading it", "POST /reject HTTP/1.1\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n", "HTTP/1.1 413 Content Too Large\r\n", 1},
+		{"The pre-check hook rejects the body", "POST /denied HTTP/1.1\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n", "HTTP/1.1 417 Expectation Failed\r\n", 0},
+		{"Unknown expectation", "POST /echo HTTP/1.1\r\nContent-Length: 5\r\nExpect: something-else\r\n\r\n", "HTTP/1.1 417 Expectation Failed\r\n", 0},
+		{"The declared body is over the limit", "POST /echo HTTP/1.1\r\nContent-Length: 17\r\nExpect: 100-continue\r\n\r\n", "HTTP/1.1 413 Content Too Large\r\n", 0},
+	}
+	for _, tc := range tests {
+		handlerCalls.Store(0)
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		_, err = conn.Write([]byte(tc.request))
+		require.NoError(t, err)
+		// the body is never sent, the connection has to be closed by the server for ReadAll() to return
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		data, err := io.ReadAll(conn)
+		conn.Close()
+		require.NoError(t, err, tc.name)
+		assert.True(t, strings.HasPrefix(string(data), tc.status), "%s: %s", tc.name, data)
+		assert.NotContains(t, string(data), "100 Continue", tc.name)
+		assert.Equal(t, tc.calls, handlerCalls.Load(), tc.name)
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	s := startTestServer(t, func(w ResponseWriter, req *request.Request) *HandlerError {
+		// a slow first request must not let the later responses overtake it
+		if req.RequestLine.URL.Path == "/slow" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		var body []byte
+		if req.RequestLine.URL.Path != "/ignored" {
+			body, _ = io.ReadAll(req.Body)
+		}
+		w.Write([]byte(req.RequestLine.URL.Path + ":" + string(body)))
+		return nil
+	})
+	defer s.Close()
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// all the requests are sent before reading any response
+	_, err = conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: test\r\n\r\n" +
+		"POST /upload HTTP/1.1\r\nHost: test\r\nContent-Length: 5\r\n\r\nhello" +
+		"POST /ignored HTTP/1.1\r\nHost: test\r\nContent-Length: 3\r\n\r\nabc" +
+		"GET /last HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	responses := strings.Split(string(data), "HTTP/1.1 200 OK\r\n")[1:]
+	require.Len(t, responses, 4, string(data))
+	for i, body := range []string{"/slow:", "/upload:hello", "/ignored:", "/last:"} {
+		assert.True(t, strings.HasSuffix(responses[i], "\r\n\r\n"+body), responses[i])
+	}
+}
+
+func TestBodylessResponses(t *testing.T) {
+	s := newServer(nil, func(w ResponseWriter, req *request.Request) *HandlerError {
+		switch req.RequestLine.RequestTarget {
+		case "/large":
+			w.Write([]byte(strings.Repeat("a", chunkingThreshold+1)))
+		case "/no-content":
+			w.WriteHeader(response.StatusCodeNoContent)
+			_, err := w.Write([]byte("ignored"))
+			assert.ErrorIs(t, err, ERROR_BODY_NOT_ALLOWED)
+		case "/not-modified":
+			w.Header().Set("Content-Length", "5")
+			w.WriteHeader(response.StatusCodeNotModified)
+		case "/error":
+			return &HandlerError{Message: "Not Found\n", StatusCode: response.StatusCodeNotFound}
+		default:
+			w.Write([]byte("hello"))
+		}
+		return nil
+	}, ServerConfig{})
+
+	// Test: HEAD gets the headers of the GET response, including its length, without the body
+	get, _, err := respondOverPipe(t, s, newTestRequest("GET", "/"))
+	require.NoError(t, err)
+	head, _, err := respondOverPipe(t, s, newTestRequest("HEAD", "/"))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length:5\r\nContent-Type:text/plain\r\n\r\nhello", get)
+	assert.Equal(t, strings.TrimSuffix(get, "hello"), head)
+
+	// Test: HEAD for a body that would be chunked
+	head, _, err = respondOverPipe(t, s, newTestRequest("HEAD", "/large"))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length:"+strconv.Itoa(chunkingThreshold+1)+"\r\nContent-Type:text/plain\r\n\r\n", head)
+
+	// Test: HEAD for an error response
+	head, _, err = respondOverPipe(t, s, newTestRequest("HEAD", "/error"))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\nContent-Length:10\r\nContent-Type:text/plain\r\n\r\n", head)
+
+	// Test: 204 has no body and no Content-Length
+	data, reuse, err := respondOverPipe(t, s, newTestRequest("GET", "/no-content"))
+	require.NoError(t, err)
+	assert.True(t, reuse)
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n\r\n", data)
+
+	// Test: 304 keeps the declared Content-Length but has no body
+	data, reuse, err = respondOverPipe(t, s, newTestRequest("GET", "/not-modified"))
+	require.NoError(t, err)
+	assert.True(t, reuse)
+	assert.Equal(t, "HTTP/1.1 304 Not Modified\r\nContent-Length:5\r\n\r\n", data)
+}
+
+// writeTestCertificate writes a self-signed certificate for commonName and its key to certFile and keyFile
+func writeTestCertificate(t *testing.T, commonName, certFile, keyFile string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+	require.NoError(t, os.WriteFile(certFile, certPEM, 0o600))
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestBodylessHandlerErrors(t *testing.T) {
+	s := startTestServer(t, func(w ResponseWriter, req *request.Request) *HandlerError {
+		switch req.RequestLine.URL.Path {
+		case "/no-content":
+			return &HandlerError{Message: "no content body", StatusCode: response.StatusCodeNoContent}
+		case "/not-modified":
+			return &HandlerError{Message: "not modified body", StatusCode: response.StatusCodeNotModified}
+		}
+		w.Write([]byte("next"))
+		return nil
+	})
+	defer s.Close()
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the message is dropped so the following response on the connection is framed correctly
+	_, err = conn.Write([]byte("GET /no-content HTTP/1.1\r\nHost: test\r\n\r\n" +
+		"GET /not-modified HTTP/1.1\r\nHost: test\r\n\r\n" +
+		"GET /next HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n\r\n"+
+		"HTTP/1.1 304 Not Modified\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\nContent-Length:4\r\nContent-Type:text/plain\r\nConnection:close\r\n\r\nnext", string(data))
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, "old.test", certFile, keyFile)
+	clientCert := writeTestCertificate(t, "client.test", filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem"))
+
+	s, err := ServeTLSWithConfig(0, certFile, keyFile, func(w ResponseWriter, req *request.Request) *HandlerError {
+		if req.TLS == nil {
+			return &HandlerError{Message: "not TLS\n", StatusCode: response.StatusCodeBadRequest}
+		}
+		w.Write([]byte(req.TLS.ServerName + " " + tls.CipherSuiteName(req.TLS.CipherSuite) + " " + strconv.Itoa(len(req.TLS.PeerCertificates))))
+		return nil
+	}, ServerConfig{TLSConfig: &tls.Config{ClientAuth: tls.RequestClientCert}})
+	require.NoError(t, err)
+	defer s.Close()
+	_, port, err := net.SplitHostPort(s.listener.Addr().String())
+	require.NoError(t, err)
+	addr := net.JoinHostPort("127.0.0.1", port)
+
+	dial := func(serverName string, certs ...tls.Certificate) *tls.Conn {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true, Certificates: certs})
+		require.NoError(t, err)
+		return conn
+	}
+	get := func(conn *tls.Conn) string {
+		_, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n"))
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		_, body, _ := strings.Cut(string(buf[:n]), "\r\n\r\n")
+		return body
+	}
+
+	// Test: The request exposes the server name, the cipher suite and the client certificates
+	conn := dial("old.test", clientCert)
+	defer conn.Close()
+	assert.Equal(t, "old.test", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	assert.Equal(t, "old.test "+tls.CipherSuiteName(conn.ConnectionState().CipherSuite)+" 1", get(conn))
+
+	// Test: A new certificate on disk is picked up by new connections
+	writeTestCertificate(t, "new.test", certFile, keyFile)
+	// make sure the change is visible even on filesystems with coarse timestamps
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	require.Eventually(t, func() bool {
+		newConn := dial("new.test")
+		defer newConn.Close()
+		return newConn.ConnectionState().PeerCertificates[0].Subject.CommonName == "new.test"
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// Test: Connections opened before the reload keep working
+	assert.Equal(t, "old.test "+tls.CipherSuiteName(conn.ConnectionState().CipherSuite)+" 1", get(conn))
+
+	// Test: A broken certificate on disk keeps the current one in use
+	require.NoError(t, os.WriteFile(certFile, []byte("not a certificate"), 0o600))
+	later = later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	time.Sleep(2 * certPollInterval)
+	newConn := dial("new.test")
+	defer newConn.Close()
+	assert.Equal(t, "new.test", newConn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+}
+
+func TestListeners(t *testing.T) {
+	handler := func(w ResponseWriter, req *request.Request) *HandlerError {
+		w.Write([]byte("ok"))
+		return nil
+	}
+	get := func(network, addr string) string {
+		conn, err := net.Dial(network, addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n"))
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		data, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	// Test: Bind address
+	s, err := ServeWithConfig(0, handler, ServerConfig{BindAddress: "127.0.0.1"})
+	require.NoError(t, err)
+	defer s.Close()
+	assert.True(t, s.listener.Addr().(*net.TCPAddr).IP.IsLoopback())
+	assert.True(t, strings.HasSuffix(get("tcp", s.listener.Addr().String()), "\r\n\r\nok"))
+
+	// Test: Unix socket with restricted permissions
+	dir := t.TempDir()
+	path := filepath.Join(dir, "http.sock")
+	listener, err := ListenUnix(path, 0o600)
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	s = ServeListener(listener, handler)
+	assert.True(t, strings.HasSuffix(get("unix", path), "\r\n\r\nok"))
+	require.NoError(t, s.Close())
+	// the socket file goes away with the listener
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	// Test: A stale socket file is replaced but a live socket and other files are left alone
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	listener, err = ListenUnix(path, 0o660)
+	require.NoError(t, err)
+	assert.Equal(t, path, listener.Addr().String())
+	s = ServeListener(listener, handler)
+	defer s.Close()
+	_, err = ListenUnix(path, 0o660)
+	assert.Error(t, err)
+	assert.True(t, strings.HasSuffix(get("unix", path), "\r\n\r\nok"))
+	require.NoError(t, s.Close())
+	// the private directory the socket was created in is gone
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	regular := filepath.Join(dir, "regular")
+	require.NoError(t, os.WriteFile(regular, nil, 0o600))
+	_, err = ListenUnix(regular, 0o600)
+	assert.Error(t, err)
+
+	// Test: Socket activation variables meant for another process are ignored and cleared
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	listeners, err := ListenersFromEnv()
+	require.NoError(t, err)
+	assert.Empty(t, listeners)
+	assert.Empty(t, os.Getenv("LISTEN_FDS"))
+
+	// Test: Without the variables there is nothing to inherit
+	listeners, err = ListenersFromEnv()
+	require.NoError(t, err)
+	assert.Empty(t, listeners)
+}
+
+// The environment variable that makes TestSocketActivation run as the child process inheriting the socket
+const socketActivationChildEnv = "GO_HTTP_SOCKET_ACTIVATION_CHILD"
+
+func TestSocketActivation(t *testing.T) {
+	if os.Getenv(socketActivationChildEnv) != "" {
+		serveInheritedSocket(t)
+		return
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	file, err := listener.(*net.TCPListener).File()
+	require.NoError(t, err)
+	// the child gets its own copy of the socket, this process stops accepting on it
+	listener.Close()
+
+	// the test binary is run again with the socket as its first extra file descriptor, the way systemd passes it
+	cmd := exec.Command(os.Args[0], "-test.run", "^TestSocketActivation$", "-test.v")
+	cmd.Env = append(os.Environ(), socketActivationChildEnv+"="+addr, "LISTEN_FDS=1")
+	cmd.ExtraFiles = []*os.File{file}
+	var output strings.Builder
+	cmd.Stdout, cmd.Stderr = &output, &output
+	require.NoError(t, cmd.Start())
+	file.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(data), "\r\n\r\ninherited"), string(data))
+	require.NoError(t, cmd.Wait(), output.String())
+}
+
+// serveInheritedSocket is the child side of TestSocketActivation, it serves a single request on the socket it was started with
+func serveInheritedSocket(t *testing.T) {
+	// LISTEN_PID can only be known once the process exists so it is set here, systemd does the same between fork and exec
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	listeners, err := ListenersFromEnv()
+	require.NoError(t, err)
+	require.Len(t, listeners, 1)
+	assert.Equal(t, os.Getenv(socketActivationChildEnv), listeners[0].Addr().String())
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS"} {
+		_, ok := os.LookupEnv(name)
+		assert.False(t, ok, name)
+	}
+
+	served := make(chan struct{})
+	s := ServeListener(listeners[0], func(w ResponseWriter, req *request.Request) *HandlerError {
+		w.Write([]byte("inherited"))
+		close(served)
+		return nil
+	})
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request on the inherited socket")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+type connState int
+
+const (
+	connStateIdle   connState = iota // 0, waiting for the next request
+	connStateActive                  // 1, a request is being handled
+)
+
+// How often Shutdown() checks whether the active connections have finished
+const shutdownPollInterval = 50 * time.Millisecond
+
+// setConnState() records the state of a connection in the registry. It returns false if the server is shutting down
+// and the connection should not wait for another request.
+func (s *Server) setConnState(conn net.Conn, state connState) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]connState)
+	}
+	s.conns[conn] = state
+	// the closed flag is checked under the lock so a connection can't slip past closeIdleConns() while becoming idle
+	return state != connStateIdle || !s.closed.Load()
+}
+
+func (s *Server) forgetConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// closeIdleConns() closes the connections waiting for a request and reports whether any active ones are left
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, state := range s.conns {
+		if state == connStateIdle {
+			conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+	return len(s.conns) == 0
+}
+
+func (s *Server) closeAllConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+}
+
+// Shutdown() stops accepting new connections, closes the idle ones and waits for the active ones to finish their current request.
+// If ctx expires first the remaining requests' contexts are cancelled, their connections are closed and the context's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed.Store(true)
+	s.mu.Unlock()
+	err := s.listener.Close()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			// long running handlers such as streams watch their request's context to know they have to stop
+			s.cancelBase()
+			s.closeAllConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	defaultIdleTimeout          = 5 * time.Second
+	defaultReadHeaderTimeout    = 10 * time.Second
+	defaultMaxRequestLineLength = 8 << 10
+	defaultMaxHeaderBytes       = 1 << 20
+	defaultMaxHeaderCount       = 100
+	defaultMaxBodySize          = 10 << 20
+)
+
+// withDefaults() fills in the timeouts and limits that were left at zero
+func (c ServerConfig) withDefaults() ServerConfig {
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = defaultIdleTimeout
+	}
+	if c.ReadHeaderTimeout == 0 {
+		c.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+	if c.MaxRequestLineLength == 0 {
+		c.MaxRequestLineLength = defaultMaxRequestLineLength
+	}
+	if c.MaxHeaderBytes == 0 {
+		c.MaxHeaderBytes = defaultMaxHeaderBytes
+	}
+	if c.MaxHeaderCount == 0 {
+		c.MaxHeaderCount = defaultMaxHeaderCount
+	}
+	if c.MaxBodySize == 0 {
+		c.MaxBodySize = defaultMaxBodySize
+	}
+	return c
+}
+
+// deadlineAfter() converts a timeout into a deadline, a timeout that isn't positive means there is no deadline
+func deadlineAfter(start time.Time, timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return start.Add(timeout)
+}
+
+// earliest() returns the deadline that expires first, ignoring unset ones
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// requestReader moves the read deadline of a connection along as a request comes in: the idle timeout applies until the first byte arrives,
+// then the header timeout until the headers are parsed and the read timeout covers the whole request.
+type requestReader struct {
+	conn    net.Conn
+	config  ServerConfig
+	started bool
+	start   time.Time
+}
+
+func newRequestReader(conn net.Conn, config ServerConfig) *requestReader {
+	return &requestReader{conn: conn, config: config}
+}
+
+// next() starts the timeouts over for the next request on the connection, buffered means part of it has already been read along with the previous one
+func (r *requestReader) next(buffered bool) {
+	r.started = false
+	// the write timeout belongs to the previous response, an error response to this request must not inherit it
+	r.conn.SetWriteDeadline(time.Time{})
+	if buffered {
+		r.markStarted()
+		return
+	}
+	r.conn.SetReadDeadline(deadlineAfter(time.Now(), r.config.IdleTimeout))
+}
+
+func (r *requestReader) Read(data []byte) (int, error) {
+	n, err := r.conn.Read(data)
+	if n > 0 && !r.started {
+		r.markStarted()
+	}
+	return n, err
+}
+
+func (r *requestReader) markStarted() {
+	r.started = true
+	r.start = time.Now()
+	r.conn.SetReadDeadline(earliest(deadlineAfter(r.start, r.config.ReadHeaderTimeout), deadlineAfter(r.start, r.config.ReadTimeout)))
+}
+
+// headersDone() switches from the header timeout to the read timeout for the body
+func (r *requestReader) headersDone() {
+	r.conn.SetReadDeadline(deadlineAfter(r.start, r.config.ReadTimeout))
+}
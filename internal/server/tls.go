@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How often the certificate files are checked for changes
+const certPollInterval = time.Second
+
+// Same as Serve() but over TLS with the certificate and key in certFile and keyFile.
+// The files are loaded again on SIGHUP or when they change on disk, only new handshakes see the new certificate so open connections are left alone.
+func ServeTLS(port int, certFile, keyFile string, handler Handler) (*Server, error) {
+	return ServeTLSWithConfig(port, certFile, keyFile, handler, ServerConfig{})
+}
+
+// Same as ServeTLS() but with custom settings, config.TLSConfig can be used for the other TLS options such as client certificates
+func ServeTLSWithConfig(port int, certFile, keyFile string, handler Handler, config ServerConfig) (*Server, error) {
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config.TLSConfig = certs.tlsConfig(config.TLSConfig)
+	server, err := ServeWithConfig(port, handler, config)
+	if err != nil {
+		return nil, err
+	}
+	// the watcher stops with the server
+	go certs.watch(server.baseCtx)
+	return server, nil
+}
+
+// certReloader hands the current certificate to every handshake and swaps it when the files are loaded again
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	// the modification time of the files when they were last loaded, a failed load also counts so a broken pair isn't retried until it changes again
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	certs := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := certs.load(); err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// tlsConfig() returns a copy of base that takes its certificate from the reloader
+func (cr *certReloader) tlsConfig(base *tls.Config) *tls.Config {
+	config := &tls.Config{}
+	if base != nil {
+		config = base.Clone()
+	}
+	// GetCertificate is only used when there are no static certificates
+	config.Certificates = nil
+	config.GetCertificate = cr.getCertificate
+	return config
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// load() reads the certificate and key, the current certificate stays in use if they can't be loaded
+func (cr *certReloader) load() error {
+	modTime, err := cr.filesModTime()
+	if err != nil {
+		return err
+	}
+	cr.mu.Lock()
+	cr.modTime = modTime
+	cr.mu.Unlock()
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading the TLS certificate:%w", err)
+	}
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.mu.Unlock()
+	return nil
+}
+
+// filesModTime() returns the latest modification time of the certificate and key files
+func (cr *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("error loading the TLS certificate:%w", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// changed() reports whether the files were modified since they were last loaded
+func (cr *certReloader) changed() bool {
+	modTime, err := cr.filesModTime()
+	if err != nil {
+		// the files may be in the middle of being replaced, the next check will pick them up
+		return false
+	}
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return !modTime.Equal(cr.modTime)
+}
+
+// watch() loads the files again on SIGHUP or when they change until ctx is cancelled
+func (cr *certReloader) watch(ctx context.Context) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	ticker := time.NewTicker(certPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+		case <-ticker.C:
+			if !cr.changed() {
+				continue
+			}
+		}
+		if err := cr.load(); err != nil {
+			log.Printf("keeping the current TLS certificate: %v", err)
+			continue
+		}
+		log.Printf("reloaded the TLS certificate from %s", cr.certFile)
+	}
+}